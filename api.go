@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+const apiPrefix = "/api/v1"
+const maxRequestBody = 1 << 20
+const maxWait = time.Hour
+
+type APIError struct {
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+}
+
+type APIErrorResponse struct {
+	Error *APIError `json:"error"`
+}
+
+type StartRunRequest struct {
+	Params   map[string]any `json:"params,omitempty"`
+	Priority *int           `json:"priority,omitempty"`
+}
+
+type StartRunResponse struct {
+	TaskID string    `json:"taskId"`
+	RunID  int64     `json:"runId"`
+	Run    *LogEntry `json:"run,omitempty"` // the final state if wait is specified
+}
+
+type RerunRequest struct {
+	Step string `json:"step,omitempty"` // run only the step
+}
+
+type ApprovalRequest struct {
+	Step     string `json:"step,omitempty"` // the task itself if empty
+	Approved bool   `json:"approved"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type ServerStatus struct {
+	Paused       bool `json:"paused"`
+	ShuttingDown bool `json:"shuttingDown"`
+}
+
+type InvokeRequest struct {
+	Params map[string]any `json:"params,omitempty"`
+}
+
+type InvokeResponse struct {
+	Success bool           `json:"success"`
+	Message string         `json:"message,omitempty"`
+	Result  map[string]any `json:"result,omitempty"`
+}
+
+type TaskResponse struct {
+	Task     *TaskConfig     `json:"task"`
+	Schedule *SchedulerEntry `json:"schedule,omitempty"`
+}
+
+type ValidationResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+type ScheduleRequest struct {
+	Spec string `json:"spec"`
+}
+
+// apiRoute is used for both the handler registration and the OpenAPI document.
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Query    map[string]string // name -> type
+	Request  any
+	Response any
+	Status   int // default: 200
+	handler  http.HandlerFunc
+}
+
+func apiRoutes() []*apiRoute {
+	return []*apiRoute{
+		{Method: "GET", Path: "/tasks", Summary: "List tasks", Response: []*TaskListItem{}, handler: apiListTasks},
+		{Method: "GET", Path: "/tasks/{taskId}", Summary: "Get task", Response: &TaskResponse{}, handler: apiGetTask},
+		{Method: "GET", Path: "/tasks/{taskId}/validation", Summary: "Validate task", Response: &ValidationResponse{}, handler: apiValidateTask},
+		{Method: "GET", Path: "/tasks/{taskId}/runs", Summary: "List runs", Query: map[string]string{"limit": "integer"}, Response: []*LogEntry{}, handler: apiListRuns},
+		{Method: "POST", Path: "/tasks/{taskId}/runs", Summary: "Start run", Query: map[string]string{"wait": "string"}, Request: &StartRunRequest{}, Response: &StartRunResponse{}, Status: http.StatusCreated, handler: apiStartRun},
+		{Method: "POST", Path: "/tasks/{taskId}/invoke", Summary: "Invoke task synchronously", Request: &InvokeRequest{}, Response: &InvokeResponse{}, handler: apiInvokeTask},
+		{Method: "GET", Path: "/runs/{taskId}/{runId}", Summary: "Get run", Query: map[string]string{"wait": "string"}, Response: &LogEntry{}, handler: apiGetRun},
+		{Method: "POST", Path: "/runs/{taskId}/{runId}/rerun", Summary: "Rerun failed steps", Query: map[string]string{"wait": "string"}, Request: &RerunRequest{}, Response: &StartRunResponse{}, Status: http.StatusCreated, handler: apiRerun},
+		{Method: "POST", Path: "/runs/{taskId}/{runId}/approval", Summary: "Approve or reject step", Request: &ApprovalRequest{}, Status: http.StatusNoContent, handler: apiApprove},
+		{Method: "POST", Path: "/runs/{taskId}/{runId}/pause", Summary: "Pause run", Status: http.StatusNoContent, handler: apiPauseRun},
+		{Method: "POST", Path: "/runs/{taskId}/{runId}/resume", Summary: "Resume run", Status: http.StatusNoContent, handler: apiPauseRun},
+		{Method: "DELETE", Path: "/runs/{taskId}/{runId}", Summary: "Stop run", Status: http.StatusNoContent, handler: apiStopRun},
+		{Method: "GET", Path: "/server", Summary: "Get server status", Response: &ServerStatus{}, handler: apiServerStatus},
+		{Method: "POST", Path: "/server/pause", Summary: "Pause all runs", Status: http.StatusNoContent, handler: apiPauseServer},
+		{Method: "POST", Path: "/server/resume", Summary: "Resume all runs", Status: http.StatusNoContent, handler: apiPauseServer},
+		{Method: "GET", Path: "/schedules", Summary: "List schedules", Response: []*SchedulerEntry{}, handler: apiListSchedules},
+		{Method: "GET", Path: "/schedules/{taskId}", Summary: "Get schedule", Response: &SchedulerEntry{}, handler: apiGetSchedule},
+		{Method: "PUT", Path: "/schedules/{taskId}", Summary: "Set schedule", Request: &ScheduleRequest{}, Response: &SchedulerEntry{}, handler: apiSetSchedule},
+		{Method: "DELETE", Path: "/schedules/{taskId}", Summary: "Remove schedule", Status: http.StatusNoContent, handler: apiRemoveSchedule},
+	}
+}
+
+func registerAPI(mux *http.ServeMux) {
+	routes := apiRoutes()
+	for _, route := range routes {
+		mux.HandleFunc(route.Method+" "+apiPrefix+route.Path, route.handler)
+	}
+	doc := NewOpenAPI(routes)
+	mux.HandleFunc("GET "+apiPrefix+"/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		responseJson(w, doc)
+	})
+	mux.HandleFunc(apiPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "unknown endpoint")
+	})
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string, details ...string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&APIErrorResponse{Error: &APIError{Code: code, Message: message, Details: details}})
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, res any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+func apiAuthorize(w http.ResponseWriter, r *http.Request, taskID, action string) bool {
+	if auth.Allowed(PrincipalFromContext(r.Context()), taskID, action) {
+		return true
+	}
+	log.Println("forbidden:", principalName(r), r.Method, r.URL.Path)
+	writeAPIError(w, http.StatusForbidden, "forbidden", "action "+action+" is not allowed")
+	return false
+}
+
+func apiLoadTask(w http.ResponseWriter, r *http.Request, action string) (*TaskConfig, bool) {
+	taskID := r.PathValue("taskId")
+	task, err := manager.Load(taskID)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "task not found: "+taskID)
+		return nil, false
+	}
+	return task, apiAuthorize(w, r, taskID, action)
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody))
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return false
+	}
+	return true
+}
+
+func apiListTasks(w http.ResponseWriter, r *http.Request) {
+	tasks := []*TaskListItem{}
+	for _, t := range manager.Tasks() {
+		if auth.Allowed(PrincipalFromContext(r.Context()), t.TaskID, ActionRead) {
+			tasks = append(tasks, t)
+		}
+	}
+	writeAPIResponse(w, http.StatusOK, tasks)
+}
+
+func apiGetTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, &TaskResponse{Task: task, Schedule: scheduler.GetSchedule(task.TaskID)})
+}
+
+func apiValidateTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	res := &ValidationResponse{Valid: true}
+	var verr *ValidationError
+	if errors.As(task.Validate(), &verr) {
+		res.Valid = false
+		res.Errors = verr.Errors
+	}
+	writeAPIResponse(w, http.StatusOK, res)
+}
+
+func apiListRuns(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	limit := 50
+	if s := r.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request", "invalid limit: "+s)
+			return
+		}
+	}
+	runs := runner.GetHistory(task.TaskID, limit)
+	if runs == nil {
+		runs = []*LogEntry{}
+	}
+	writeAPIResponse(w, http.StatusOK, runs)
+}
+
+// apiWait returns the max duration to wait for the run to finish. (e.g. ?wait=30s)
+func apiWait(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	s := r.URL.Query().Get("wait")
+	if s == "" {
+		return 0, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 || d > maxWait {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "invalid wait: "+s)
+		return 0, false
+	}
+	return d, true
+}
+
+func waitRun(r *http.Request, taskID string, runID int64, d time.Duration) (*LogEntry, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	defer cancel()
+	ent, err := runner.WaitRun(ctx, taskID, runID)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// return the current state
+		err = nil
+	}
+	return ent, err
+}
+
+func apiStartRun(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionStart)
+	if !ok {
+		return
+	}
+	wait, ok := apiWait(w, r)
+	if !ok {
+		return
+	}
+	var req StartRunRequest
+	if r.ContentLength != 0 && !decodeRequest(w, r, &req) {
+		return
+	}
+	if req.Priority != nil {
+		task.Priority = *req.Priority
+	}
+	normalizeNumbers(req.Params)
+	ent, err := runner.Start(task, mergeParams(task.Variables, req.Params))
+	writeStartResponse(w, r, ent, err, wait)
+}
+
+func writeStartResponse(w http.ResponseWriter, r *http.Request, ent *LogEntry, err error, wait time.Duration) {
+	if err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_task", "task is invalid", verr.Errors...)
+		} else if errors.Is(err, ErrQueueFull) {
+			writeAPIError(w, http.StatusTooManyRequests, "queue_full", err.Error())
+		} else if errors.Is(err, ErrShuttingDown) {
+			writeAPIError(w, http.StatusServiceUnavailable, "shutting_down", err.Error())
+		} else if errors.Is(err, ErrRunNotFound) {
+			writeAPIError(w, http.StatusNotFound, "not_found", err.Error())
+		} else if errors.Is(err, ErrStepNotFound) {
+			writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		} else {
+			writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+		}
+		return
+	}
+	res := &StartRunResponse{TaskID: ent.TaskID, RunID: ent.RunID}
+	if wait > 0 {
+		if res.Run, err = waitRun(r, ent.TaskID, ent.RunID, wait); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, "wait_failed", err.Error())
+			return
+		}
+	}
+	writeAPIResponse(w, http.StatusCreated, res)
+}
+
+func apiRerun(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionStart)
+	if !ok {
+		return
+	}
+	runID, ok := apiRunID(w, r)
+	if !ok {
+		return
+	}
+	wait, ok := apiWait(w, r)
+	if !ok {
+		return
+	}
+	var req RerunRequest
+	if r.ContentLength != 0 && !decodeRequest(w, r, &req) {
+		return
+	}
+	ent, err := runner.Rerun(task, runID, req.Step)
+	writeStartResponse(w, r, ent, err, wait)
+}
+
+func principalName(r *http.Request) string {
+	if p := PrincipalFromContext(r.Context()); p != nil {
+		return p.Name
+	}
+	return "anonymous"
+}
+
+func apiApprove(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionApprove)
+	if !ok {
+		return
+	}
+	runID, ok := apiRunID(w, r)
+	if !ok {
+		return
+	}
+	var req ApprovalRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	err := runner.Approve(task.TaskID, runID, req.Step, &ApprovalState{Approved: req.Approved, By: principalName(r), Comment: req.Comment})
+	if errors.Is(err, ErrRunNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "run is not active")
+	} else if errors.Is(err, ErrStepNotFound) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", err.Error())
+	} else if err != nil {
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func apiInvokeTask(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionInvoke)
+	if !ok {
+		return
+	}
+	var req InvokeRequest
+	if r.ContentLength != 0 && !decodeRequest(w, r, &req) {
+		return
+	}
+	normalizeNumbers(req.Params)
+	result, err := runner.Invoke(r.Context(), task, mergeParams(task.Variables, req.Params))
+	if errors.Is(err, ErrShuttingDown) {
+		writeAPIError(w, http.StatusServiceUnavailable, "shutting_down", err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, "invoke_failed", err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, &InvokeResponse{Success: result.Success, Message: result.Message, Result: result.Result})
+}
+
+func apiRunID(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	runID, err := strconv.ParseInt(r.PathValue("runId"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_request", "invalid runId: "+r.PathValue("runId"))
+		return 0, false
+	}
+	return runID, true
+}
+
+func apiGetRun(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	runID, ok := apiRunID(w, r)
+	if !ok {
+		return
+	}
+	wait, ok := apiWait(w, r)
+	if !ok {
+		return
+	}
+	ent := runner.GetRun(task.TaskID, runID)
+	if ent != nil && wait > 0 {
+		ent, _ = waitRun(r, task.TaskID, runID, wait)
+	}
+	if ent == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "run not found")
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, ent)
+}
+
+func apiStopRun(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionStop)
+	if !ok {
+		return
+	}
+	runID, ok := apiRunID(w, r)
+	if !ok {
+		return
+	}
+	if !runner.Stop(task.TaskID, runID) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "run is not active")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiPauseRun(w http.ResponseWriter, r *http.Request) {
+	resume := strings.HasSuffix(r.URL.Path, "/resume")
+	action := ActionStop
+	if resume {
+		action = ActionStart
+	}
+	task, ok := apiLoadTask(w, r, action)
+	if !ok {
+		return
+	}
+	runID, ok := apiRunID(w, r)
+	if !ok {
+		return
+	}
+	var err error
+	if resume {
+		err = runner.Resume(task.TaskID, runID)
+	} else {
+		err = runner.Pause(task.TaskID, runID)
+	}
+	if errors.Is(err, ErrRunNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "run is not active")
+	} else if err != nil {
+		writeAPIError(w, http.StatusConflict, "conflict", err.Error())
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func apiServerStatus(w http.ResponseWriter, r *http.Request) {
+	if !apiAuthorize(w, r, "*", ActionRead) {
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, &ServerStatus{Paused: runner.Paused(), ShuttingDown: runner.ShuttingDown()})
+}
+
+// apiPauseServer pauses or resumes all the runs. Permission for all tasks is required.
+func apiPauseServer(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/resume") {
+		if !apiAuthorize(w, r, "*", ActionStart) {
+			return
+		}
+		runner.ResumeAll()
+	} else {
+		if !apiAuthorize(w, r, "*", ActionStop) {
+			return
+		}
+		runner.PauseAll()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiListSchedules(w http.ResponseWriter, r *http.Request) {
+	schedules := []*SchedulerEntry{}
+	for _, s := range scheduler.Schedules() {
+		if auth.Allowed(PrincipalFromContext(r.Context()), s.TaskID, ActionRead) {
+			schedules = append(schedules, s)
+		}
+	}
+	writeAPIResponse(w, http.StatusOK, schedules)
+}
+
+func apiGetSchedule(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionRead)
+	if !ok {
+		return
+	}
+	s := scheduler.GetSchedule(task.TaskID)
+	if s == nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "schedule not found")
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, s)
+}
+
+func apiSetSchedule(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionSchedule)
+	if !ok {
+		return
+	}
+	var req ScheduleRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	// Scheduler.Set removes the current schedule before parsing.
+	if _, err := cron.ParseStandard(req.Spec); err != nil || strings.TrimSpace(req.Spec) == "" {
+		writeAPIError(w, http.StatusBadRequest, "invalid_schedule", "invalid spec: "+req.Spec)
+		return
+	}
+	if err := scheduler.Set(task.TaskID, req.Spec); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid_schedule", err.Error())
+		return
+	}
+	writeAPIResponse(w, http.StatusOK, scheduler.GetSchedule(task.TaskID))
+}
+
+func apiRemoveSchedule(w http.ResponseWriter, r *http.Request) {
+	task, ok := apiLoadTask(w, r, ActionSchedule)
+	if !ok {
+		return
+	}
+	if !scheduler.Remove(task.TaskID) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "schedule not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PermissionNone    = ""
+	PermissionRead    = "read"
+	PermissionExecute = "execute"
+)
+
+const (
+	ActionRead     = "read"
+	ActionReadLogs = "read-logs"
+	ActionStart    = "start"
+	ActionStop     = "stop"
+	ActionInvoke   = "invoke"
+	ActionSchedule = "schedule"
+	ActionApprove  = "approve"
+)
+
+var ErrUnauthorized = errors.New("unauthorized")
+
+type Principal struct {
+	Name       string
+	Permission string
+	Roles      []string
+}
+
+func (p *Principal) Can(permission string) bool {
+	switch permission {
+	case PermissionNone:
+		return true
+	case PermissionRead:
+		return p.Permission == PermissionRead || p.Permission == PermissionExecute
+	default:
+		return p.Permission == permission
+	}
+}
+
+// Authenticator returns nil principal if the request has no credentials for it.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+type AuthUser struct {
+	Name       string   `json:"name"`
+	Password   string   `json:"password"` // bcrypt
+	Permission string   `json:"permission"`
+	Roles      []string `json:"roles"`
+}
+
+type AuthToken struct {
+	Name       string   `json:"name"`
+	Hash       string   `json:"hash"` // sha256 hex
+	Permission string   `json:"permission"`
+	Roles      []string `json:"roles"`
+}
+
+// AuthRule allows the actions for the tasks matching the glob patterns.
+type AuthRule struct {
+	Tasks   []string `json:"tasks"`
+	Actions []string `json:"actions"`
+}
+
+func (rule *AuthRule) Match(taskID, action string) bool {
+	if !slices.Contains(rule.Actions, action) && !slices.Contains(rule.Actions, "*") {
+		return false
+	}
+	for _, pattern := range rule.Tasks {
+		if ok, _ := path.Match(pattern, taskID); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type AuthConfig struct {
+	Users     []*AuthUser            `json:"users"`
+	Tokens    []*AuthToken           `json:"tokens"`
+	Roles     map[string][]*AuthRule `json:"roles"`
+	Anonymous string                 `json:"anonymous"` // permission for unauthenticated requests
+}
+
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf AuthConfig
+	if err := yaml.Unmarshal(bytes, &conf); err != nil {
+		return nil, err
+	}
+	for _, u := range conf.Users {
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			log.Println("auth: password of", u.Name, "is not a bcrypt hash")
+		}
+	}
+	return &conf, nil
+}
+
+func HashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func matchHash(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashSecret(secret)), []byte(strings.ToLower(hash))) == 1
+}
+
+// HashPassword returns the bcrypt hash of the password. SHA-256 is only for the random tokens.
+func HashPassword(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+func matchPassword(password, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+type BasicAuthenticator struct {
+	Users []*AuthUser
+}
+
+func (a *BasicAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	for _, u := range a.Users {
+		if u.Name == name && matchPassword(password, u.Password) {
+			return &Principal{Name: u.Name, Permission: u.Permission, Roles: u.Roles}, nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+type TokenAuthenticator struct {
+	Tokens []*AuthToken
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	for _, t := range a.Tokens {
+		if matchHash(token, t.Hash) {
+			return &Principal{Name: "token:" + t.Name, Permission: t.Permission, Roles: t.Roles}, nil
+		}
+	}
+	return nil, ErrUnauthorized
+}
+
+type principalKey struct{}
+
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+type Auth struct {
+	authenticators []Authenticator
+	roles          map[string][]*AuthRule
+	anonymous      string
+}
+
+func NewAuth(conf *AuthConfig) *Auth {
+	return &Auth{
+		authenticators: []Authenticator{
+			&BasicAuthenticator{Users: conf.Users},
+			&TokenAuthenticator{Tokens: conf.Tokens},
+		},
+		roles:     conf.Roles,
+		anonymous: conf.Anonymous,
+	}
+}
+
+// Allowed reports whether the principal can perform the action on the task.
+func (a *Auth) Allowed(p *Principal, taskID, action string) bool {
+	if a == nil {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	if p.Can(PermissionExecute) || p.Can(PermissionRead) && (action == ActionRead || action == ActionReadLogs) {
+		return true
+	}
+	for _, role := range p.Roles {
+		for _, rule := range a.roles[role] {
+			if rule.Match(taskID, action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Auth) authenticate(r *http.Request) (*Principal, error) {
+	for _, au := range a.authenticators {
+		p, err := au.Authenticate(r)
+		if p != nil || err != nil {
+			return p, err
+		}
+	}
+	return &Principal{Name: "anonymous", Permission: a.anonymous}, nil
+}
+
+func requiredPermission(r *http.Request) string {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return PermissionRead
+	}
+	return PermissionExecute
+}
+
+func (a *Auth) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.authenticate(r)
+		// principals with roles are checked for each task by the handlers.
+		if err != nil || !p.Can(requiredPermission(r)) && len(p.Roles) == 0 {
+			if err != nil || p.Name == "anonymous" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="gotask"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			} else {
+				log.Println("forbidden:", p.Name, r.Method, r.URL.Path)
+				http.Error(w, "forbidden", http.StatusForbidden)
+			}
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuth_Middleware(t *testing.T) {
+	hash1, _ := HashPassword("pass1")
+	hash2, _ := HashPassword("pass2")
+	auth := NewAuth(&AuthConfig{
+		Users: []*AuthUser{
+			{Name: "reader", Password: hash1, Permission: PermissionRead},
+			{Name: "admin", Password: hash2, Permission: PermissionExecute},
+			{Name: "legacy", Password: HashSecret("pass3"), Permission: PermissionExecute},
+		},
+		Tokens: []*AuthToken{
+			{Name: "ci", Hash: HashSecret("token1"), Permission: PermissionExecute},
+		},
+	})
+	handler := auth.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if PrincipalFromContext(r.Context()) == nil {
+			t.Error("no principal")
+		}
+	}))
+
+	tests := []struct {
+		method string
+		setup  func(r *http.Request)
+		status int
+	}{
+		{"GET", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"GET", func(r *http.Request) { r.SetBasicAuth("reader", "pass1") }, http.StatusOK},
+		{"POST", func(r *http.Request) { r.SetBasicAuth("reader", "pass1") }, http.StatusForbidden},
+		{"POST", func(r *http.Request) { r.SetBasicAuth("admin", "pass2") }, http.StatusOK},
+		{"GET", func(r *http.Request) { r.SetBasicAuth("admin", "wrong") }, http.StatusUnauthorized},
+		{"GET", func(r *http.Request) { r.SetBasicAuth("legacy", "pass3") }, http.StatusUnauthorized},
+		{"POST", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token1") }, http.StatusOK},
+		{"GET", func(r *http.Request) { r.Header.Set("Authorization", "Bearer token2") }, http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/tasks/", nil)
+		tt.setup(r)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("#%d: status %d != %d", i, w.Code, tt.status)
+		}
+	}
+}
+
+func TestAuth_Allowed(t *testing.T) {
+	auth := NewAuth(&AuthConfig{
+		Roles: map[string][]*AuthRule{
+			"deployer": {
+				{Tasks: []string{"deploy-*"}, Actions: []string{ActionRead, ActionStart, ActionStop}},
+				{Tasks: []string{"*"}, Actions: []string{ActionRead}},
+			},
+		},
+	})
+	p := &Principal{Name: "bob", Roles: []string{"deployer"}}
+	tests := []struct {
+		taskID string
+		action string
+		ok     bool
+	}{
+		{"deploy-web", ActionStart, true},
+		{"deploy-web", ActionSchedule, false},
+		{"backup", ActionRead, true},
+		{"backup", ActionStart, false},
+		{"backup", ActionReadLogs, false},
+	}
+	for _, tt := range tests {
+		if auth.Allowed(p, tt.taskID, tt.action) != tt.ok {
+			t.Errorf("Allowed(%s, %s) != %v", tt.taskID, tt.action, tt.ok)
+		}
+	}
+	if !auth.Allowed(&Principal{Permission: PermissionRead}, "backup", ActionReadLogs) {
+		t.Error("read permission should allow read-logs")
+	}
+	if (*Auth)(nil).Allowed(nil, "backup", ActionStart) != true {
+		t.Error("nil Auth should allow all")
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const cliPollInterval = time.Second
+const cliWaitInterval = time.Minute // max wait for each request
+
+// exit codes of the cli
+const (
+	exitSuccess  = 0
+	exitFailed   = 1
+	exitUsage    = 2
+	exitTimeout  = 124
+	exitCanceled = 130
+)
+
+const cliUsage = `Usage:
+  gotask [serve]                          start the server
+  gotask run [-p KEY=VAL]... [--wait] [--local] <task>
+  gotask rerun [--step name] [--wait] <task> <runId>
+  gotask approve [--step name] [--reject] [--comment text] <task> <runId>
+  gotask pause <task> <runId> | --all
+  gotask resume <task> <runId> | --all
+  gotask logs [--follow] <task> <runId>
+  gotask ls [task]
+  gotask schedule ls
+  gotask schedule set <task> <spec>
+  gotask schedule rm <task>
+
+Environment:
+  GOTASK_SERVER  server url (default: http://localhost:8080)
+  GOTASK_TOKEN   bearer token
+`
+
+type paramsFlag map[string]any
+
+func (p paramsFlag) String() string { return fmt.Sprint(map[string]any(p)) }
+
+func (p paramsFlag) Set(v string) error {
+	k, v, ok := strings.Cut(v, "=")
+	if !ok {
+		return errors.New("expected KEY=VAL")
+	}
+	p[k] = v
+	return nil
+}
+
+// parseArgs parses the flags placed before or after the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func exitCode(status string) int {
+	switch status {
+	case "success", "skipped":
+		return exitSuccess
+	case "timeout":
+		return exitTimeout
+	case "canceled", "interrupted":
+		return exitCanceled
+	default:
+		return exitFailed
+	}
+}
+
+// leafSteps returns the steps that write the logs.
+func leafSteps(ts *TaskState, steps []*TaskState) []*TaskState {
+	if len(ts.Steps) == 0 {
+		return append(steps, ts)
+	}
+	for _, s := range ts.Steps {
+		steps = leafSteps(s, steps)
+	}
+	return steps
+}
+
+type apiClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func newAPIClient() *apiClient {
+	server := os.Getenv("GOTASK_SERVER")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+	return &apiClient{server: strings.TrimSuffix(server, "/"), token: os.Getenv("GOTASK_TOKEN"), client: http.DefaultClient}
+}
+
+func (c *apiClient) request(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		defer res.Body.Close()
+		var e APIErrorResponse
+		b, _ := io.ReadAll(res.Body)
+		if json.Unmarshal(b, &e) == nil && e.Error != nil {
+			msg := e.Error.Code + ": " + e.Error.Message
+			if len(e.Error.Details) > 0 {
+				msg += " (" + strings.Join(e.Error.Details, ", ") + ")"
+			}
+			return nil, errors.New(msg)
+		}
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(b)))
+	}
+	return res, nil
+}
+
+func (c *apiClient) call(method, path string, req, res any) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	r, err := c.request(method, apiPrefix+path, body)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(res)
+}
+
+func (c *apiClient) getRun(taskID string, runID int64, wait time.Duration) (*LogEntry, error) {
+	var ent LogEntry
+	path := fmt.Sprintf("/runs/%s/%d", url.PathEscape(taskID), runID)
+	if wait > 0 {
+		path += "?wait=" + wait.String()
+	}
+	return &ent, c.call("GET", path, nil, &ent)
+}
+
+func (c *apiClient) waitRun(taskID string, runID int64) (*LogEntry, error) {
+	for {
+		ent, err := c.getRun(taskID, runID, cliWaitInterval)
+		if err != nil || ent.Task.finished() {
+			return ent, err
+		}
+	}
+}
+
+// printLog writes the log file. The log is streamed until the step is finished if follow is true.
+func (c *apiClient) printLog(w io.Writer, logFile string, follow bool) error {
+	req, err := http.NewRequest("GET", c.server+"/tasklogs/"+logFile, nil)
+	if err != nil {
+		return err
+	}
+	if follow {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("%s: %s", logFile, res.Status)
+	}
+	if !follow {
+		_, err = io.Copy(w, res.Body)
+		return err
+	}
+	scanner := bufio.NewScanner(res.Body)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if e, ok := strings.CutPrefix(line, "event: "); ok {
+			event = e
+		} else if d, ok := strings.CutPrefix(line, "data: "); ok && event == "log" {
+			fmt.Fprintln(w, d)
+		} else if line == "" && event == "end" {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func cliRun(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	params := paramsFlag{}
+	fs.Var(params, "p", "parameter KEY=VAL (repeatable)")
+	wait := fs.Bool("wait", false, "wait for the run to finish")
+	local := fs.Bool("local", false, "run the task without the server")
+	tasksDir := fs.String("tasks", "", "tasks directory for --local")
+	priority := fs.Int("priority", 0, "priority of the run")
+	pos, err := parseArgs(fs, args)
+	if err != nil || len(pos) != 1 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	if *local {
+		return runLocal(pos[0], *tasksDir, params)
+	}
+
+	c := newAPIClient()
+	req := &StartRunRequest{Params: params}
+	if *priority != 0 {
+		req.Priority = priority
+	}
+	return c.startRun("/tasks/"+url.PathEscape(pos[0])+"/runs", req, *wait)
+}
+
+// startRun posts the request and waits for the run if wait is true.
+func (c *apiClient) startRun(path string, req any, wait bool) int {
+	var res StartRunResponse
+	if err := c.call("POST", path, req, &res); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	fmt.Println(res.RunID)
+	if !wait {
+		return exitSuccess
+	}
+	ent, err := c.waitRun(res.TaskID, res.RunID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	printSteps(os.Stderr, ent.Task, "")
+	return exitCode(ent.Task.Status)
+}
+
+func cliRerun(args []string) int {
+	fs := flag.NewFlagSet("rerun", flag.ContinueOnError)
+	step := fs.String("step", "", "run only the step")
+	wait := fs.Bool("wait", false, "wait for the run to finish")
+	pos, err := parseArgs(fs, args)
+	if err != nil || len(pos) != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	runID, err := strconv.ParseInt(pos[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	c := newAPIClient()
+	return c.startRun(fmt.Sprintf("/runs/%s/%d/rerun", url.PathEscape(pos[0]), runID), &RerunRequest{Step: *step}, *wait)
+}
+
+func cliApprove(args []string) int {
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	step := fs.String("step", "", "step waiting for approval")
+	reject := fs.Bool("reject", false, "reject the step")
+	comment := fs.String("comment", "", "comment")
+	pos, err := parseArgs(fs, args)
+	if err != nil || len(pos) != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	runID, err := strconv.ParseInt(pos[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	req := &ApprovalRequest{Step: *step, Approved: !*reject, Comment: *comment}
+	if err := newAPIClient().call("POST", fmt.Sprintf("/runs/%s/%d/approval", url.PathEscape(pos[0]), runID), req, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitSuccess
+}
+
+// cliPause pauses or resumes the run, or all the runs of the server.
+func cliPause(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	all := fs.Bool("all", false, "all runs of the server")
+	pos, err := parseArgs(fs, args)
+	if err != nil || *all != (len(pos) == 0) || !*all && len(pos) != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	path := "/server/" + name
+	if !*all {
+		runID, err := strconv.ParseInt(pos[1], 10, 64)
+		if err != nil {
+			fmt.Fprint(os.Stderr, cliUsage)
+			return exitUsage
+		}
+		path = fmt.Sprintf("/runs/%s/%d/%s", url.PathEscape(pos[0]), runID, name)
+	}
+	if err := newAPIClient().call("POST", path, nil, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitSuccess
+}
+
+func printSteps(w io.Writer, ts *TaskState, indent string) {
+	fmt.Fprintf(w, "%s%s\t%s\t%s\n", indent, ts.Name, ts.Status, ts.Message)
+	for _, s := range ts.Steps {
+		printSteps(w, s, indent+"  ")
+	}
+}
+
+// runLocal runs the task in this process and writes the logs of the steps when they are finished.
+func runLocal(taskID, tasksDir string, params map[string]any) int {
+	m := NewManager(&ManagerConfig{TasksDir: tasksDir})
+	task, err := m.Load(taskID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	logDir, err := os.MkdirTemp("", "gotask_logs_")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	defer os.RemoveAll(logDir)
+	conf, err := LoadRunnerConfig(runnerConfigPath())
+	if err != nil {
+		conf = &RunnerConfig{}
+	}
+	// keep the queues only. logs are discarded and no notifications are sent.
+	r := NewRunner(&RunnerConfig{Queues: conf.Queues, Parallel: conf.Parallel, LogDir: logDir})
+	updates, unsubscribe := r.Subscribe()
+	defer unsubscribe()
+
+	ent, err := r.Start(task, mergeParams(task.Variables, params))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	printed := map[string]bool{}
+	printFinished := func(ent *LogEntry) {
+		for _, s := range leafSteps(ent.Task, nil) {
+			if key := s.Name + ":" + s.LogFile; !printed[key] && s.finished() {
+				printed[key] = true
+				fmt.Fprintf(os.Stderr, "==> %s: %s\n", s.Name, s.Status)
+				if b, err := os.ReadFile(filepath.Join(logDir, s.LogFile)); err == nil {
+					os.Stdout.Write(b)
+				}
+			}
+		}
+	}
+	result := make(chan *LogEntry, 1)
+	go func() {
+		ent, _ := r.WaitRun(context.Background(), ent.TaskID, ent.RunID)
+		result <- ent
+	}()
+	// the commands don't receive the signals from the terminal since they run in their own process groups.
+	interrupted, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	signaled := interrupted.Done()
+	for {
+		select {
+		case <-signaled:
+			stop() // the second signal terminates gotask
+			signaled = nil
+			r.Stop(ent.TaskID, ent.RunID)
+		case ent := <-updates:
+			printFinished(ent)
+		case ent := <-result:
+			printFinished(ent)
+			printSteps(os.Stderr, ent.Task, "")
+			return exitCode(ent.Task.Status)
+		}
+	}
+}
+
+func cliLogs(args []string) int {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "stream the logs until the run is finished")
+	fs.BoolVar(follow, "f", false, "shorthand for --follow")
+	pos, err := parseArgs(fs, args)
+	if err != nil || len(pos) != 2 {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	runID, err := strconv.ParseInt(pos[1], 10, 64)
+	if err != nil {
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	c := newAPIClient()
+	printed := map[string]bool{}
+	for {
+		ent, err := c.getRun(pos[0], runID, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+		steps := leafSteps(ent.Task, nil)
+		for _, s := range steps {
+			if s.LogFile == "" || printed[s.LogFile] || *follow && !s.active() && !s.finished() {
+				continue
+			}
+			printed[s.LogFile] = true
+			if len(steps) > 1 {
+				fmt.Fprintf(os.Stderr, "==> %s <==\n", s.Name)
+			}
+			if err := c.printLog(os.Stdout, s.LogFile, *follow); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
+		if !*follow || ent.Task.finished() {
+			return exitCode(ent.Task.Status)
+		}
+		time.Sleep(cliPollInterval)
+	}
+}
+
+func cliList(args []string) int {
+	c := newAPIClient()
+	if len(args) == 0 {
+		var tasks []*TaskListItem
+		if err := c.call("GET", "/tasks", nil, &tasks); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitFailed
+		}
+		for _, t := range tasks {
+			fmt.Println(t.TaskID)
+		}
+		return exitSuccess
+	}
+	var runs []*LogEntry
+	if err := c.call("GET", "/tasks/"+url.PathEscape(args[0])+"/runs", nil, &runs); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	for _, ent := range runs {
+		fmt.Printf("%d\t%s\t%s\n", ent.RunID, ent.Task.Status, time.UnixMilli(ent.Task.StartedAt).Format(time.DateTime))
+	}
+	return exitSuccess
+}
+
+func cliSchedule(args []string) int {
+	c := newAPIClient()
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "ls":
+		var schedules []*SchedulerEntry
+		if err = c.call("GET", "/schedules", nil, &schedules); err == nil {
+			for _, s := range schedules {
+				fmt.Printf("%s\t%s\n", s.TaskID, s.Spec)
+			}
+		}
+	case len(args) == 3 && args[0] == "set":
+		err = c.call("PUT", "/schedules/"+url.PathEscape(args[1]), &ScheduleRequest{Spec: args[2]}, nil)
+	case len(args) == 2 && args[0] == "rm":
+		err = c.call("DELETE", "/schedules/"+url.PathEscape(args[1]), nil, nil)
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return exitUsage
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFailed
+	}
+	return exitSuccess
+}
+
+// runCommand runs the cli subcommand and returns the exit code.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "run":
+		return cliRun(args[1:])
+	case "rerun":
+		return cliRerun(args[1:])
+	case "approve":
+		return cliApprove(args[1:])
+	case "pause", "resume":
+		return cliPause(args[0], args[1:])
+	case "logs":
+		return cliLogs(args[1:])
+	case "ls":
+		return cliList(args[1:])
+	case "schedule":
+		return cliSchedule(args[1:])
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+			return exitSuccess
+		}
+		return exitUsage
+	}
+}
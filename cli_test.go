@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	params := paramsFlag{}
+	fs.Var(params, "p", "")
+	wait := fs.Bool("wait", false, "")
+	pos, err := parseArgs(fs, []string{"-p", "A=1", "task1", "--wait", "-p", "B=x=y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pos) != 1 || pos[0] != "task1" {
+		t.Errorf("unexpected args: %v", pos)
+	}
+	if !*wait || params["A"] != "1" || params["B"] != "x=y" {
+		t.Errorf("unexpected flags: %v %v", *wait, params)
+	}
+	if _, err := parseArgs(fs, []string{"task1", "-p", "A"}); err == nil {
+		t.Error("invalid param should be an error")
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/binzume/goja_utils v0.0.0-20251207151131-039fb4c9d401
 	github.com/dop251/goja v0.0.0-20251121114222-56b1242a5f86
 	github.com/robfig/cron/v3 v3.0.1
+	golang.org/x/crypto v0.31.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -14,5 +15,5 @@ require (
 	github.com/dop251/goja_nodejs v0.0.0-20251015164255-5e94316bedaf // indirect
 	github.com/go-sourcemap/sourcemap v2.1.4+incompatible // indirect
 	github.com/google/pprof v0.0.0-20240727154555-813a5fbdbec8 // indirect
-	golang.org/x/text v0.16.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
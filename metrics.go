@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+type histogram struct {
+	counts []uint64 // cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, b := range durationBuckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+type stepKey struct {
+	taskID string
+	step   string
+}
+
+type statusKey struct {
+	taskID string
+	status string
+}
+
+// Metrics collects the statistics of the runs.
+type Metrics struct {
+	mutex         sync.Mutex
+	started       map[string]uint64
+	finished      map[statusKey]uint64
+	stepDurations map[stepKey]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		started:       map[string]uint64{},
+		finished:      map[statusKey]uint64{},
+		stepDurations: map[stepKey]*histogram{},
+	}
+}
+
+func (m *Metrics) runStarted(log *LogEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.started[log.TaskID]++
+}
+
+func (m *Metrics) runFinished(log *LogEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.finished[statusKey{log.TaskID, log.Task.Status}]++
+	if len(log.Task.Steps) == 0 {
+		m.observeSteps(log.TaskID, "", log.Task)
+	}
+	for _, s := range log.Task.Steps {
+		m.observeSteps(log.TaskID, "", s)
+	}
+}
+
+func (m *Metrics) observeSteps(taskID, prefix string, ts *TaskState) {
+	if len(ts.Steps) == 0 {
+		if ts.StartedAt == 0 || ts.FinishedAt < ts.StartedAt || ts.ReusedFrom != 0 {
+			return
+		}
+		key := stepKey{taskID, prefix + ts.Name}
+		if m.stepDurations[key] == nil {
+			m.stepDurations[key] = &histogram{}
+		}
+		m.stepDurations[key].observe(float64(ts.FinishedAt-ts.StartedAt) / 1000)
+		return
+	}
+	for _, s := range ts.Steps {
+		m.observeSteps(taskID, prefix+ts.Name+".", s)
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (m *Metrics) Write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeMetricHeader(w, "gotask_runs_started_total", "counter", "Number of started runs.")
+	for _, id := range sortedKeys(m.started, func(a, b string) bool { return a < b }) {
+		fmt.Fprintf(w, "gotask_runs_started_total{task_id=\"%s\"} %d\n", escapeLabel(id), m.started[id])
+	}
+
+	writeMetricHeader(w, "gotask_runs_finished_total", "counter", "Number of finished runs by status.")
+	for _, k := range sortedKeys(m.finished, func(a, b statusKey) bool {
+		return a.taskID < b.taskID || a.taskID == b.taskID && a.status < b.status
+	}) {
+		fmt.Fprintf(w, "gotask_runs_finished_total{task_id=\"%s\",status=\"%s\"} %d\n", escapeLabel(k.taskID), escapeLabel(k.status), m.finished[k])
+	}
+
+	writeMetricHeader(w, "gotask_step_duration_seconds", "histogram", "Duration of the steps.")
+	for _, k := range sortedKeys(m.stepDurations, func(a, b stepKey) bool {
+		return a.taskID < b.taskID || a.taskID == b.taskID && a.step < b.step
+	}) {
+		h := m.stepDurations[k]
+		labels := fmt.Sprintf("task_id=\"%s\",step=\"%s\"", escapeLabel(k.taskID), escapeLabel(k.step))
+		for i, b := range durationBuckets {
+			fmt.Fprintf(w, "gotask_step_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "gotask_step_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(w, "gotask_step_duration_seconds_sum{%s} %g\n", labels, h.sum)
+		fmt.Fprintf(w, "gotask_step_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+func sortedKeys[K comparable, V any](m map[K]V, less func(a, b K) bool) []K {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
+func writeQueueMetrics(w io.Writer, queues []*QueueStats) {
+	gauges := []struct {
+		name  string
+		typ   string
+		help  string
+		value func(q *QueueStats) float64
+	}{
+		{"gotask_queue_pending", "gauge", "Number of entries waiting in the queue.", func(q *QueueStats) float64 { return float64(q.Pending) }},
+		{"gotask_queue_running", "gauge", "Number of slots in use.", func(q *QueueStats) float64 { return float64(q.Running) }},
+		{"gotask_queue_parallel", "gauge", "Number of slots.", func(q *QueueStats) float64 { return float64(q.Parallel) }},
+		{"gotask_queue_size", "gauge", "Max number of pending entries.", func(q *QueueStats) float64 { return float64(q.Size) }},
+		{"gotask_queue_waiting", "gauge", "Number of entries blocked until the queue has space.", func(q *QueueStats) float64 { return float64(q.Waiting) }},
+		{"gotask_queue_backlog", "gauge", "Number of runs in the backlog.", func(q *QueueStats) float64 { return float64(q.Backlog) }},
+		{"gotask_queue_rejected_total", "counter", "Number of entries rejected since the queue is full.", func(q *QueueStats) float64 { return float64(q.Rejected) }},
+	}
+	for _, g := range gauges {
+		writeMetricHeader(w, g.name, g.typ, g.help)
+		for _, q := range queues {
+			fmt.Fprintf(w, "%s{queue=\"%s\"} %g\n", g.name, escapeLabel(q.Name), g.value(q))
+		}
+	}
+}
+
+func writeScheduleMetrics(w io.Writer, next map[string]time.Time) {
+	writeMetricHeader(w, "gotask_schedule_next_timestamp_seconds", "gauge", "Next fire time of the schedules.")
+	for _, id := range sortedKeys(next, func(a, b string) bool { return a < b }) {
+		fmt.Fprintf(w, "gotask_schedule_next_timestamp_seconds{task_id=\"%s\"} %d\n", escapeLabel(id), next[id].Unix())
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	notifyTimeout   = 30 * time.Second
+	logExcerptBytes = 4096
+)
+
+type SMTPConfig struct {
+	Addr     string   `json:"addr"` // host:port
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"-"`
+}
+
+type NotifyConfig struct {
+	On      []string    `json:"on"` // success, failure or canceled. default: failure
+	Webhook string      `json:"webhook,omitempty"`
+	SMTP    *SMTPConfig `json:"smtp,omitempty"`
+	Command string      `json:"command,omitempty"`
+}
+
+type Notification struct {
+	TaskID      string   `json:"taskId"`
+	RunID       int64    `json:"runId"`
+	Status      string   `json:"status"`
+	Message     string   `json:"message,omitempty"`
+	FailedSteps []string `json:"failedSteps,omitempty"`
+	LogExcerpt  string   `json:"logExcerpt,omitempty"`
+}
+
+func notifyEvent(status string) string {
+	switch status {
+	case "success", "canceled":
+		return status
+	default:
+		return "failure"
+	}
+}
+
+func (conf *NotifyConfig) enabled(status string) bool {
+	on := conf.On
+	if len(on) == 0 {
+		on = []string{"failure"}
+	}
+	return slices.Contains(on, notifyEvent(status))
+}
+
+func failedSteps(ts *TaskState, steps []*TaskState) []*TaskState {
+	for _, s := range ts.Steps {
+		if len(s.Steps) > 0 {
+			steps = failedSteps(s, steps)
+		} else if s.finished() && !s.succeeded() && s.Status != "upstream_failed" {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+func readLogTail(path string, n int64) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if st, err := f.Stat(); err == nil && st.Size() > n {
+		f.Seek(-n, io.SeekEnd)
+	}
+	b, _ := io.ReadAll(f)
+	return string(b)
+}
+
+func NewNotification(ent *LogEntry, logDir string) *Notification {
+	n := &Notification{
+		TaskID:  ent.TaskID,
+		RunID:   ent.RunID,
+		Status:  ent.Task.Status,
+		Message: ent.Task.Message,
+	}
+	failed := failedSteps(ent.Task, nil)
+	if len(ent.Task.Steps) == 0 && ent.Task.Status != "success" {
+		failed = append(failed, ent.Task)
+	}
+	for _, s := range failed {
+		n.FailedSteps = append(n.FailedSteps, s.Name)
+	}
+	if len(failed) > 0 && failed[0].LogFile != "" {
+		n.LogExcerpt = readLogTail(filepath.Join(logDir, failed[0].LogFile), logExcerptBytes)
+	}
+	return n
+}
+
+func (n *Notification) Subject() string {
+	return fmt.Sprintf("[gotask] %s %s (run %d)", n.TaskID, n.Status, n.RunID)
+}
+
+func (n *Notification) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Task: %s\nRun: %d\nStatus: %s\n", n.TaskID, n.RunID, n.Status)
+	if n.Message != "" {
+		fmt.Fprintf(&b, "Message: %s\n", n.Message)
+	}
+	if len(n.FailedSteps) > 0 {
+		fmt.Fprintf(&b, "Failed steps: %s\n", strings.Join(n.FailedSteps, ", "))
+	}
+	if n.LogExcerpt != "" {
+		fmt.Fprintf(&b, "\n%s\n", n.LogExcerpt)
+	}
+	return b.String()
+}
+
+// Send sends the notification to all configured destinations.
+func (conf *NotifyConfig) Send(ctx context.Context, n *Notification) error {
+	var errs []error
+	if conf.Webhook != "" {
+		errs = append(errs, sendWebhook(ctx, conf.Webhook, n))
+	}
+	if conf.SMTP != nil {
+		errs = append(errs, sendMail(ctx, conf.SMTP, n))
+	}
+	if conf.Command != "" {
+		errs = append(errs, runNotifyCommand(ctx, conf.Command, n))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sendWebhook(ctx context.Context, url string, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
+
+// sendMail is smtp.SendMail with the deadline of ctx for the connection.
+func sendMail(ctx context.Context, conf *SMTPConfig, n *Notification) error {
+	host, _, _ := strings.Cut(conf.Addr, ":")
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", conf.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if conf.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", conf.Username, conf.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(conf.From); err != nil {
+		return err
+	}
+	for _, to := range conf.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%s",
+		conf.From, strings.Join(conf.To, ", "), n.Subject(), strings.ReplaceAll(n.Text(), "\n", "\r\n"))
+	if _, err := w.Write([]byte(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func runNotifyCommand(ctx context.Context, command string, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"GOTASK_TASK_ID="+n.TaskID,
+		fmt.Sprintf("GOTASK_RUN_ID=%d", n.RunID),
+		"GOTASK_STATUS="+n.Status,
+		"GOTASK_FAILED_STEPS="+strings.Join(n.FailedSteps, ","),
+	)
+	cmd.Stdin = bytes.NewReader(body)
+	return cmd.Run()
+}
+
+// notify sends the notification for the finished run according to the task or global config.
+func (r *Runner) notify(config *TaskConfig, ent *LogEntry) {
+	conf := config.Notify
+	if conf == nil {
+		conf = r.notifyConfig
+	}
+	if conf == nil || !conf.enabled(ent.Task.Status) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.notifyCtx, notifyTimeout)
+	defer cancel()
+	if err := conf.Send(ctx, NewNotification(ent, r.logDir)); err != nil {
+		log.Println("failed to notify", ent.TaskID, err)
+	}
+}
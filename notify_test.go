@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyConfig_Enabled(t *testing.T) {
+	tests := []struct {
+		on      []string
+		status  string
+		enabled bool
+	}{
+		{nil, "failed", true},
+		{nil, "timeout", true},
+		{nil, "success", false},
+		{nil, "canceled", false},
+		{[]string{"success"}, "success", true},
+		{[]string{"success"}, "failed", false},
+		{[]string{"canceled"}, "canceled", true},
+		{[]string{"success", "failure"}, "interrupted", true},
+	}
+	for _, tt := range tests {
+		if (&NotifyConfig{On: tt.on}).enabled(tt.status) != tt.enabled {
+			t.Errorf("on %v, %s: should be %v", tt.on, tt.status, tt.enabled)
+		}
+	}
+}
+
+func TestNotifyConfig_Send(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "a.log"), []byte("build error\n"), 0644)
+	ent := &LogEntry{TaskID: "notify", RunID: 1, Task: &TaskState{Status: "failed", Steps: []*TaskState{
+		{Name: "a", Status: "failed", LogFile: "a.log"},
+		{Name: "b", Status: "upstream_failed"},
+		{Name: "c", Status: "success"},
+	}}}
+	n := NewNotification(ent, dir)
+	// upstream_failed steps are not reported.
+	if strings.Join(n.FailedSteps, ",") != "a" || n.LogExcerpt != "build error\n" {
+		t.Errorf("unexpected notification: %v %q", n.FailedSteps, n.LogExcerpt)
+	}
+
+	var received Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer server.Close()
+	out := filepath.Join(dir, "notified")
+	conf := &NotifyConfig{
+		Webhook: server.URL,
+		Command: `echo "$GOTASK_STATUS $GOTASK_FAILED_STEPS" > ` + out + `; cat >> ` + out,
+	}
+	if err := conf.Send(context.Background(), n); err != nil {
+		t.Fatal(err)
+	}
+	if received.TaskID != "notify" || received.RunID != 1 || received.Status != "failed" || received.LogExcerpt != n.LogExcerpt {
+		t.Errorf("unexpected webhook: %+v", received)
+	}
+	b, _ := os.ReadFile(out)
+	line, body, _ := strings.Cut(string(b), "\n")
+	var n2 Notification
+	if line != "failed a" || json.Unmarshal([]byte(body), &n2) != nil || n2.RunID != 1 {
+		t.Errorf("unexpected command input: %q", b)
+	}
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	if err := (&NotifyConfig{Webhook: server.URL}).Send(context.Background(), n); err == nil {
+		t.Error("webhook error should be returned")
+	}
+}
+
+func TestNotifyConfig_SendTimeout(t *testing.T) {
+	// the server accepts the connection but never responds.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	conf := &NotifyConfig{SMTP: &SMTPConfig{Addr: l.Addr().String(), From: "gotask@example.com", To: []string{"admin@example.com"}}}
+	start := time.Now()
+	if err := conf.Send(ctx, &Notification{TaskID: "notify"}); err == nil || time.Since(start) > time.Second {
+		t.Errorf("should be timed out: %v %v", err, time.Since(start))
+	}
+
+	// the waiters are not blocked by the slow notification.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+	}))
+	defer server.Close()
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir(), Notify: &NotifyConfig{Webhook: server.URL}})
+	start = time.Now()
+	ent, _ := r.RunAndWait(context.Background(), &TaskConfig{TaskID: "notify", Command: "exit 1"}, nil)
+	if ent.Task.Status != "failed" || time.Since(start) > 300*time.Millisecond {
+		t.Errorf("should not wait for the notification: %s %v", ent.Task.Status, time.Since(start))
+	}
+	r.Shutdown(context.Background())
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var pathParamRe = regexp.MustCompile(`\{(\w+)\}`)
+
+// schemaGenerator converts Go types to OpenAPI schemas. Named structs are stored in components.
+type schemaGenerator struct {
+	schemas map[string]any
+}
+
+func (g *schemaGenerator) schema(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			g.schemas[t.Name()] = nil // for recursive types
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		return map[string]any{}
+	}
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	g.addFields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func (g *schemaGenerator) addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			g.addFields(ft, props, required)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// NewOpenAPI returns the OpenAPI document for the routes.
+func NewOpenAPI(routes []*apiRoute) map[string]any {
+	g := &schemaGenerator{schemas: map[string]any{}}
+	errorResponse := map[string]any{
+		"description": "Error",
+		"content":     map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(APIErrorResponse{}))}},
+	}
+	paths := map[string]any{}
+	for _, route := range routes {
+		var params []any
+		for _, m := range pathParamRe.FindAllStringSubmatch(route.Path, -1) {
+			typ := "string"
+			if m[1] == "runId" {
+				typ = "integer"
+			}
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": typ}})
+		}
+		for name, typ := range route.Query {
+			params = append(params, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": typ}})
+		}
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		res := map[string]any{"description": http.StatusText(status)}
+		if route.Response != nil {
+			res["content"] = map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(route.Response))}}
+		}
+		op := map[string]any{
+			"summary":   route.Summary,
+			"responses": map[string]any{strconv.Itoa(status): res, "default": errorResponse},
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if route.Request != nil {
+			op["requestBody"] = map[string]any{
+				"required": route.Method == "PUT",
+				"content":  map[string]any{"application/json": map[string]any{"schema": g.schema(reflect.TypeOf(route.Request))}},
+			}
+		}
+		if paths[route.Path] == nil {
+			paths[route.Path] = map[string]any{}
+		}
+		paths[route.Path].(map[string]any)[strings.ToLower(route.Method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "gotask API", "version": "v1"},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []any{map[string]any{"basic": []any{}}, map[string]any{"bearer": []any{}}, map[string]any{}},
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPI(t *testing.T) {
+	routes := apiRoutes()
+	doc := NewOpenAPI(routes)
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+	paths := doc["paths"].(map[string]any)
+	for _, route := range routes {
+		op, ok := paths[route.Path].(map[string]any)[strings.ToLower(route.Method)].(map[string]any)
+		if !ok {
+			t.Errorf("%s %s not found", route.Method, route.Path)
+			continue
+		}
+		if strings.Contains(route.Path, "{") && op["parameters"] == nil {
+			t.Errorf("%s %s has no parameters", route.Method, route.Path)
+		}
+	}
+	schemas := doc["components"].(map[string]any)["schemas"].(map[string]any)
+	for _, name := range []string{"TaskState", "TaskConfig", "APIError"} {
+		if schemas[name] == nil {
+			t.Errorf("schema %s not found", name)
+		}
+	}
+	props := schemas["WebhookConfig"].(map[string]any)["properties"].(map[string]any)
+	if _, ok := props["Secret"]; ok {
+		t.Error("secret should not be exposed")
+	}
+}
@@ -11,14 +11,18 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 var manager = NewManager(nil)
-var runner = NewRunner(nil)
+var runner *Runner
 var scheduler *Scheduler
+var auth *Auth // nil if authentication is disabled
 
 //go:embed static/*
 var staticFS embed.FS
@@ -33,7 +37,33 @@ func responseJson(w http.ResponseWriter, res interface{}) {
 	w.Write(json)
 }
 
-func handlePostTask(ctx context.Context, w http.ResponseWriter, task *TaskConfig, vars url.Values) {
+// authorize writes 403 response if the action is not allowed.
+func authorize(w http.ResponseWriter, r *http.Request, taskID, action string) bool {
+	p := PrincipalFromContext(r.Context())
+	if auth.Allowed(p, taskID, action) {
+		return true
+	}
+	log.Println("denied:", p.Name, action, taskID)
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
+}
+
+// writeStartError writes the status code for the error from Runner.Start.
+func writeStartError(w http.ResponseWriter, err error) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+	} else if errors.Is(err, ErrQueueFull) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if errors.Is(err, ErrShuttingDown) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+func handlePostTask(w http.ResponseWriter, r *http.Request, task *TaskConfig, vars url.Values) {
 	res := struct {
 		TaskID  string `json:"taskId"`
 		RunID   int64  `json:"runId"`
@@ -56,39 +86,94 @@ func handlePostTask(ctx context.Context, w http.ResponseWriter, task *TaskConfig
 		}
 		return params
 	}
-	if action == "stop" {
+	switch action {
+	case ActionStop, ActionInvoke, "rerun", "approve", "reject", "pause", "resume":
+	default:
+		action = ActionStart
+	}
+	permission := action
+	switch action {
+	case "rerun", "resume":
+		permission = ActionStart
+	case "approve", "reject":
+		permission = ActionApprove
+	case "pause":
+		permission = ActionStop
+	}
+	if !authorize(w, r, task.TaskID, permission) {
+		return
+	}
+	if p := vars.Get("priority"); p != "" {
+		task.Priority, _ = strconv.Atoi(p)
+	}
+	if action == ActionStop {
 		id, _ := strconv.ParseInt(vars.Get("runId"), 10, 64)
 		res.Ok = runner.Stop(task.TaskID, id)
 		res.RunID = id
-	} else if action == "invoke" {
-		r, _ := runner.Invoke(ctx, task, getParams())
-		if r.Success && r.Result != nil {
-			if body, ok := r.Result["body"].(string); ok {
-				if headers, ok := r.Result["headers"].(map[string]any); ok {
+	} else if action == "pause" || action == "resume" {
+		id, _ := strconv.ParseInt(vars.Get("runId"), 10, 64)
+		var err error
+		if action == "pause" {
+			err = runner.Pause(task.TaskID, id)
+		} else {
+			err = runner.Resume(task.TaskID, id)
+		}
+		res.RunID = id
+		res.Ok = err == nil
+		if err != nil {
+			res.Message = err.Error()
+		}
+	} else if action == "approve" || action == "reject" {
+		id, _ := strconv.ParseInt(vars.Get("runId"), 10, 64)
+		err := runner.Approve(task.TaskID, id, vars.Get("step"), &ApprovalState{Approved: action == "approve", By: principalName(r), Comment: vars.Get("comment")})
+		res.RunID = id
+		res.Ok = err == nil
+		if err != nil {
+			res.Message = err.Error()
+		}
+	} else if action == ActionInvoke {
+		result, err := runner.Invoke(r.Context(), task, getParams())
+		if err != nil {
+			writeStartError(w, err)
+			responseJson(w, map[string]any{"ok": false, "message": err.Error()})
+			return
+		}
+		if result.Success && result.Result != nil {
+			if body, ok := result.Result["body"].(string); ok {
+				if headers, ok := result.Result["headers"].(map[string]any); ok {
 					for k, v := range headers {
 						w.Header().Set(k, fmt.Sprint(v))
 					}
 				} else {
 					w.Header().Set("Content-Type", "text/plain")
 				}
-				if status, ok := r.Result["statusCode"].(int); ok {
+				if status, ok := result.Result["statusCode"].(int); ok {
 					w.WriteHeader(status)
 				}
 				w.Write([]byte(body))
 				return
 			}
-			responseJson(w, r.Result)
+			responseJson(w, result.Result)
 			return
 		}
-		res.Message = r.Message
-		res.Ok = r.Success
+		res.Message = result.Message
+		res.Ok = result.Success
 	} else {
-		ent, err := runner.Start(task, getParams())
+		var ent *LogEntry
+		var err error
+		if action == "rerun" {
+			id, _ := strconv.ParseInt(vars.Get("runId"), 10, 64)
+			ent, err = runner.Rerun(task, id, vars.Get("step"))
+		} else {
+			ent, err = runner.Start(task, getParams())
+		}
 		if err == nil {
 			res.RunID = ent.RunID
 			res.Ok = true
 		} else {
 			res.Ok = false
+			res.Message = err.Error()
+			writeStartError(w, err)
 		}
 	}
 	responseJson(w, &res)
@@ -97,7 +182,13 @@ func handlePostTask(ctx context.Context, w http.ResponseWriter, task *TaskConfig
 func taskHandler(w http.ResponseWriter, r *http.Request) {
 	taskID := strings.SplitN(r.URL.Path, "/", 2)[0]
 	if taskID == "" {
-		responseJson(w, manager.Tasks())
+		var tasks []*TaskListItem
+		for _, t := range manager.Tasks() {
+			if auth.Allowed(PrincipalFromContext(r.Context()), t.TaskID, ActionRead) {
+				tasks = append(tasks, t)
+			}
+		}
+		responseJson(w, tasks)
 		return
 	}
 	task, err := manager.Load(taskID)
@@ -107,7 +198,27 @@ func taskHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	if r.Method == "POST" {
 		r.ParseMultipartForm(4096)
-		handlePostTask(r.Context(), w, task, r.PostForm)
+		handlePostTask(w, r, task, r.PostForm)
+		return
+	}
+	if !authorize(w, r, taskID, ActionRead) {
+		return
+	}
+	if isEventStream(r) {
+		runEventHandler(w, r, taskID)
+		return
+	}
+	if r.URL.Query().Has("validate") {
+		res := struct {
+			Valid  bool     `json:"valid"`
+			Errors []string `json:"errors,omitempty"`
+		}{Valid: true}
+		var verr *ValidationError
+		if errors.As(task.Validate(), &verr) {
+			res.Valid = false
+			res.Errors = verr.Errors
+		}
+		responseJson(w, &res)
 		return
 	}
 
@@ -133,6 +244,9 @@ func scheduleHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
+		if !authorize(w, r, taskID, ActionSchedule) {
+			return
+		}
 		if schedule == "" {
 			scheduler.Remove(taskID)
 		} else {
@@ -143,17 +257,108 @@ func scheduleHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	responseJson(w, scheduler.Schedules())
+	var schedules []*SchedulerEntry
+	for _, s := range scheduler.Schedules() {
+		if auth.Allowed(PrincipalFromContext(r.Context()), s.TaskID, ActionRead) {
+			schedules = append(schedules, s)
+		}
+	}
+	responseJson(w, schedules)
+}
+
+func queueHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.SplitN(r.URL.Path, "/", 2)[0]
+	if name == "" {
+		if !authorize(w, r, "", ActionRead) {
+			return
+		}
+		responseJson(w, runner.Queues())
+		return
+	}
+	queue := runner.Queue(name)
+	if queue == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		r.ParseMultipartForm(4096)
+		id := r.PostForm.Get("id")
+		taskID := strings.SplitN(id, ":", 2)[0]
+		res := struct {
+			ID string `json:"id"`
+			Ok bool   `json:"ok"`
+		}{ID: id}
+		switch r.PostForm.Get("action") {
+		case "cancel":
+			if !authorize(w, r, taskID, ActionStop) {
+				return
+			}
+			res.Ok = queue.Cancel(id)
+		case "front":
+			if !authorize(w, r, taskID, ActionStart) {
+				return
+			}
+			res.Ok = queue.MoveToFront(id)
+		default:
+			http.Error(w, "unknown action", http.StatusBadRequest)
+			return
+		}
+		responseJson(w, &res)
+		return
+	}
+	if !authorize(w, r, "", ActionRead) {
+		return
+	}
+	stats := queue.Stats()
+	stats.Name = name
+	res := struct {
+		*QueueStats
+		PendingEntries []*PendingEntry `json:"pendingEntries"`
+	}{stats, queue.Pending()}
+	responseJson(w, &res)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorize(w, r, "", ActionRead) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	runner.Metrics().Write(w)
+	writeQueueMetrics(w, runner.Queues())
+	writeScheduleMetrics(w, scheduler.NextTimes())
+}
+
+func runnerConfigPath() string {
+	if path := os.Getenv("GOTASK_RUNNER_CONFIG"); path != "" {
+		return path
+	}
+	return "tasks/_runner.yaml"
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	serve()
+}
+
+func serve() {
 	fixedtz := os.Getenv("GOTASK_FIXED_TZ") // ex: JST-9
 	if p := strings.LastIndexAny(fixedtz, "+-"); p >= 0 {
 		offset, _ := strconv.Atoi(fixedtz[p:])
 		time.Local = time.FixedZone(fixedtz, -offset*3600)
 	}
+	conf, err := LoadRunnerConfig(runnerConfigPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Fatal(err)
+	}
+	conf = conf.FillDefault()
+	runner = NewRunner(conf)
+	if err := runner.Recover(manager); err != nil {
+		log.Println(err)
+	}
 	scheduler = NewScheduler(manager, runner, "tasks/_schedules.yaml")
-	err := scheduler.Start()
+	err = scheduler.Start()
 	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Println(err)
 	}
@@ -172,7 +377,56 @@ func main() {
 		http.Handle("/", http.FileServer(http.FS(static)))
 	}
 	http.Handle("/tasks/", http.StripPrefix("/tasks/", http.HandlerFunc(taskHandler)))
-	http.Handle("/tasklogs/", http.StripPrefix("/tasklogs/", http.FileServer(http.Dir(runner.LogDir()))))
+	logFileServer := http.FileServer(http.Dir(runner.LogDir()))
+	http.Handle("/tasklogs/", http.StripPrefix("/tasklogs/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		taskID := strings.SplitN(path.Clean("/" + r.URL.Path)[1:], "/", 2)[0]
+		if !authorize(w, r, taskID, ActionReadLogs) {
+			return
+		}
+		if isEventStream(r) {
+			logStreamHandler(w, r)
+		} else {
+			logFileServer.ServeHTTP(w, r)
+		}
+	})))
 	http.Handle("/schedules/", http.StripPrefix("/schedules/", http.HandlerFunc(scheduleHandler)))
-	http.ListenAndServe(host+":"+port, nil)
+	http.Handle("/queues/", http.StripPrefix("/queues/", http.HandlerFunc(queueHandler)))
+	http.HandleFunc("/metrics", metricsHandler)
+	registerAPI(http.DefaultServeMux)
+
+	var handler http.Handler = http.DefaultServeMux
+	authConf := os.Getenv("GOTASK_AUTH_CONFIG")
+	if authConf == "" {
+		authConf = "tasks/_auth.yaml"
+	}
+	if conf, err := LoadAuthConfig(authConf); err == nil {
+		auth = NewAuth(conf)
+		handler = auth.Middleware(handler)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		log.Println("WARNING: authentication is disabled.", authConf, "not found")
+	} else {
+		log.Fatal(err)
+	}
+	// webhooks are authenticated by the signature instead.
+	mux := http.NewServeMux()
+	mux.Handle("/hooks/", http.StripPrefix("/hooks/", http.HandlerFunc(webhookHandler)))
+	mux.Handle("/", handler)
+	server := &http.Server{Addr: host + ":" + port, Handler: mux}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+	signal.Stop(sig) // the second signal exits immediately.
+	log.Println("shutting down...")
+	scheduler.Stop()
+	// keep serving the API to show the progress until the runs finish.
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+	defer cancel()
+	runner.Shutdown(ctx)
+	server.Close()
 }
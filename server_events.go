@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const logPollInterval = 500 * time.Millisecond
+
+func isEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func startEventStream(w http.ResponseWriter) (http.Flusher, bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return nil, false
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return flusher, true
+}
+
+func writeEvent(w http.ResponseWriter, event string, data []byte) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(string(data), "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+// logStreamHandler tails a log file until the step writing it is finished.
+func logStreamHandler(w http.ResponseWriter, r *http.Request) {
+	logFile := path.Clean("/" + r.URL.Path)[1:]
+	f, err := os.Open(filepath.Join(runner.LogDir(), filepath.FromSlash(logFile)))
+	if err != nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+
+	reader := bufio.NewReader(f)
+	var partial []byte
+	for {
+		// check before reading to send the last lines after the step is finished.
+		active := runner.StepActive(logFile)
+		for {
+			line, err := reader.ReadBytes('\n')
+			partial = append(partial, line...)
+			if err != nil {
+				break
+			}
+			writeEvent(w, "log", partial[:len(partial)-1])
+			partial = partial[:0]
+		}
+		if !active {
+			if len(partial) > 0 {
+				writeEvent(w, "log", partial)
+			}
+			writeEvent(w, "end", nil)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(logPollInterval):
+		}
+	}
+}
+
+// runEventHandler sends the state of the runs of the task on each change.
+func runEventHandler(w http.ResponseWriter, r *http.Request, taskID string) {
+	runID, _ := strconv.ParseInt(r.URL.Query().Get("runId"), 10, 64)
+	flusher, ok := startEventStream(w)
+	if !ok {
+		return
+	}
+	updates, unsubscribe := runner.Subscribe()
+	defer unsubscribe()
+
+	send := func(ent *LogEntry) {
+		json, _ := json.Marshal(ent)
+		writeEvent(w, "update", json)
+		flusher.Flush()
+	}
+	var current *LogEntry
+	for _, ent := range runner.RunningTaks(taskID) {
+		if runID == 0 || ent.RunID == runID {
+			current = ent
+			send(ent)
+		}
+	}
+	var done <-chan struct{}
+	if runID != 0 {
+		done = runner.Done(taskID, runID)
+		if done == nil || current == nil {
+			for _, ent := range runner.GetHistory(taskID, runner.recentLimit) {
+				if ent.RunID == runID {
+					send(ent)
+				}
+			}
+			writeEvent(w, "end", nil)
+			return
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			// the latest update may not be received yet.
+			if ent := runner.GetRun(taskID, runID); ent != nil {
+				send(ent)
+			}
+			writeEvent(w, "end", nil)
+			return
+		case ent := <-updates:
+			if ent.TaskID == taskID && (runID == 0 || ent.RunID == runID) {
+				send(ent)
+			}
+		}
+	}
+}
@@ -30,10 +30,16 @@ function formatDate(s) {
 		[d2(t.getHours()), d2(t.getMinutes())].join(":");
 }
 
+function isActive(status) {
+	return status == 'queued' || status == 'running' || status == 'retrying' || status == 'waiting_approval' || status == 'paused';
+}
+
 class TaskView {
 	constructor() {
 		this.currentTask = null;
 		this.currentLog = null;
+		this.logSource = null;
+		this.runSource = null;
 
 		document.getElementById('task-start-button').addEventListener('click', (e) => {
 			e.preventDefault();
@@ -64,24 +70,35 @@ class TaskView {
 			return;
 		}
 
+		this.currentRunId = run.runId;
 		let steps = run.task.steps;
 		if (!steps || !steps.length) {
 			steps = [run.task];
 		}
 		for (let step of steps) {
 			let color = 'white';
-			if (step.status == 'queued') {
+			if (step.status == 'queued' || step.status == 'backlog') {
 				color = '#aaa';
 			} else if (step.status == 'running') {
 				color = '#8f8';
+			} else if (step.status == 'retrying') {
+				color = '#fc8';
+			} else if (step.status == 'waiting_approval' || step.status == 'paused') {
+				color = '#8cf';
 			} else if (step.status == 'finished') {
 				color = '#6d6';
 			} else if (step.status == 'success') {
 				color = '#6d6';
-			} else if (step.status == 'failed') {
+			} else if (step.status == 'failed' || step.status == 'rejected') {
 				color = '#f00';
 			} else if (step.status == 'canceled') {
 				color = '#ff6';
+			} else if (step.status == 'timeout') {
+				color = '#f80';
+			} else if (step.status == 'interrupted') {
+				color = '#c8c';
+			} else if (step.status == 'skipped' || step.status == 'upstream_failed') {
+				color = '#ddd';
 			}
 			let time = step.finishedAt ? '(' + formatTime(step.finishedAt - step.startedAt) + ')' : '';
 			let o = { id: step.name, type: 'task', o: step, srcIds: step.depends || [], text: (step.status || '') + time, lane: 0, connectColor: 'black', color: color };
@@ -91,11 +108,24 @@ class TaskView {
 			graph.add(o);
 		}
 		graph.build(svg, (node) => {
-			this.updateTaskLog(node.o.logFile);
+			this.updateTaskLog(node.o.logFile, isActive(node.o.status));
 			this.updateTaskInfo(node.o);
 		});
 	}
 
+	async pauseTask(taskId, runId, pause) {
+		let data = new FormData();
+		data.append("action", pause ? "pause" : "resume");
+		data.append("runId", runId);
+		let res = await fetch(apiUrl + 'tasks/' + taskId, { method: "POST", body: data });
+		let result = await res.json().catch(() => null);
+		if (!res.ok || !result?.ok) {
+			alert(result?.message || 'Failed to pause ' + taskId);
+			return;
+		}
+		setTimeout(() => this.updateTask(taskId), 200);
+	}
+
 	async stopTask(taskId, runId) {
 		let data = new FormData();
 		data.append("action", "stop");
@@ -108,6 +138,19 @@ class TaskView {
 		setTimeout(() => this.updateTask(taskId), 200);
 	}
 
+	async rerunTask(taskId, runId) {
+		let data = new FormData();
+		data.append("action", "rerun");
+		data.append("runId", runId);
+		let res = await fetch(apiUrl + 'tasks/' + taskId, { method: "POST", body: data });
+		let result = await res.json().catch(() => null);
+		if (!res.ok || !result?.ok) {
+			alert(result?.message || 'Failed to rerun ' + taskId);
+			return;
+		}
+		setTimeout(() => this.updateTask(taskId), 0);
+	}
+
 	async startTask(taskId) {
 		if (!taskId) {
 			taskId = this.currentTask;
@@ -117,7 +160,9 @@ class TaskView {
 		// TODO: edit variables
 		// data.append("VARS.TEST", "test");
 		let res = await fetch(apiUrl + 'tasks/' + taskId, { method: "POST", body: data });
-		if (!res.ok) {
+		let result = await res.json().catch(() => null);
+		if (!res.ok || !result?.ok) {
+			alert(result?.message || 'Failed to start ' + taskId);
 			return;
 		}
 		setTimeout(() => this.updateTask(taskId), 0);
@@ -141,19 +186,72 @@ class TaskView {
 		if (t.message) {
 			infoEl.append(mkEl('span', t.message, { className: 'task-errormessage' }));
 		}
+		if (t.peakMemory || t.cpuTime) {
+			infoEl.append(mkEl('div', `Peak memory: ${(t.peakMemory / 1048576).toFixed(1)}MB, CPU time: ${(t.cpuTime / 1000).toFixed(2)}s`));
+		}
+		if (t.approval) {
+			infoEl.append(mkEl('div', `${t.approval.approved ? 'Approved' : 'Rejected'} by ${t.approval.by || '-'} at ${formatDate(t.approval.at)}`));
+		}
+		if (t.status == 'waiting_approval') {
+			let taskId = this.currentTask, runId = this.currentRunId;
+			let step = t.name == taskId ? '' : t.name;
+			infoEl.append(
+				mkEl('button', 'Approve', { onclick: () => this.approveStep(taskId, runId, step, true) }),
+				mkEl('button', 'Reject', { onclick: () => this.approveStep(taskId, runId, step, false) }),
+			);
+		}
 	}
 
-	async updateTaskLog(logfile) {
+	async approveStep(taskId, runId, step, approved) {
+		let comment = prompt(approved ? 'Approve' : 'Reject', '');
+		if (comment == null) {
+			return;
+		}
+		let data = new FormData();
+		data.append("action", approved ? "approve" : "reject");
+		data.append("runId", runId);
+		data.append("step", step);
+		data.append("comment", comment);
+		let res = await fetch(apiUrl + 'tasks/' + taskId, { method: "POST", body: data });
+		let result = await res.json().catch(() => null);
+		if (!res.ok || !result?.ok) {
+			alert(result?.message || 'Failed to approve ' + taskId);
+			return;
+		}
+		setTimeout(() => this.updateTask(taskId), 200);
+	}
+
+	async updateTaskLog(logfile, follow) {
 		let logEl = document.getElementById('task-log');
 		if (logfile != this.currentLog) {
 			logEl.innerText = '';
 		}
+		if (this.logSource && (logfile != this.currentLog || !follow)) {
+			this.logSource.close();
+			this.logSource = null;
+		}
 		this.currentLog = logfile;
 		if (!logfile) {
 			logEl.style.display = 'none';
 			return;
 		}
 		logEl.style.display = 'block';
+		if (follow) {
+			if (this.logSource) {
+				return;
+			}
+			logEl.innerText = '';
+			let source = new EventSource(apiUrl + 'tasklogs/' + logfile);
+			source.addEventListener('log', (ev) => {
+				logEl.append(ev.data + '\n');
+				logEl.scrollTop = logEl.scrollHeight;
+			});
+			source.addEventListener('end', (ev) => {
+				source.close();
+			});
+			this.logSource = source;
+			return;
+		}
 		let res = await fetch(apiUrl + 'tasklogs/' + logfile);
 		if (!res.ok) {
 			logEl.innerText = 'Log not found';
@@ -165,7 +263,7 @@ class TaskView {
 
 	selectRun(run) {
 		if  (run?.task?.steps == null && run?.task?.logFile) {
-			this.updateTaskLog(run.task.logFile);
+			this.updateTaskLog(run.task.logFile, isActive(run.task.status));
 		} else {
 			this.updateTaskLog(null);
 		}
@@ -200,6 +298,8 @@ class TaskView {
 		let lastRun = taskRes.recent && taskRes.recent[0];
 		this.updateGraph(lastRun || taskRes);
 		this.selectRun(lastRun);
+		this.watchRun(taskId, lastRun);
+		this.validateTask(taskId);
 
 		historyEl.innerText = '';
 		titleEl.innerText = taskId;
@@ -218,7 +318,17 @@ class TaskView {
 				el.append(mkEl('span', '.', { className: 'status-' + st.status }));
 			}
 			el.append(mkEl('span', ['(', time, ')'], { className: 'task-time' }));
-			if (t.status == 'running' || t.status == 'queued') {
+			if (t.steps && (t.status == 'running' || t.status == 'paused')) {
+				let pause = t.status == 'running';
+				el.append(mkEl('button', pause ? '⏸' : '▶', {
+					title: pause ? 'Pause' : 'Resume',
+					onclick: (ev) => {
+						ev.stopPropagation();
+						this.pauseTask(taskId, log.runId, pause);
+					}
+				}));
+			}
+			if (t.status == 'running' || t.status == 'queued' || t.status == 'backlog' || t.status == 'paused') {
 				el.append(mkEl('button', '■', {
 					onclick: (ev) => {
 						if (confirm(`Stop ${taskId}?`)) {
@@ -227,6 +337,17 @@ class TaskView {
 					}
 				}));
 			}
+			if (t.steps && ['failed', 'timeout', 'canceled', 'interrupted'].includes(t.status)) {
+				el.append(mkEl('button', '↻', {
+					title: 'Rerun failed steps',
+					onclick: (ev) => {
+						ev.stopPropagation();
+						if (confirm(`Rerun failed steps of ${taskId}?`)) {
+							this.rerunTask(taskId, log.runId);
+						}
+					}
+				}));
+			}
 			historyEl.append(el);
 			el.onclick = () => {
 				this.updateGraph(log);
@@ -235,6 +356,40 @@ class TaskView {
 		}
 	}
 
+	async validateTask(taskId) {
+		let res = await fetch(apiUrl + 'tasks/' + taskId + '?validate');
+		if (!res.ok) {
+			return;
+		}
+		let result = await res.json();
+		if (!result.valid) {
+			let infoEl = document.getElementById('task-info');
+			for (let err of result.errors) {
+				infoEl.append(mkEl('div', err, { className: 'task-errormessage' }));
+			}
+		}
+	}
+
+	watchRun(taskId, run) {
+		if (this.runSource) {
+			this.runSource.close();
+			this.runSource = null;
+		}
+		if (!run || !isActive(run.task.status)) {
+			return;
+		}
+		let source = new EventSource(apiUrl + 'tasks/' + taskId + '?runId=' + run.runId);
+		source.addEventListener('update', (ev) => {
+			this.updateGraph(JSON.parse(ev.data));
+		});
+		source.addEventListener('end', (ev) => {
+			source.close();
+			this.runSource = null;
+			this.updateTask(taskId);
+		});
+		this.runSource = source;
+	}
+
 	async updateTaskList() {
 		let listEl = document.getElementById('task-list');
 		listEl.innerText = '';
@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/dop251/goja"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,9 +25,23 @@ type TaskConfig struct {
 	Variables        map[string]interface{}
 	Dir              string
 	Depends          []string `json:"depends"`
+	Trigger          string   `json:"trigger,omitempty"` // all_success, all_done, one_failed or always
+	When             string   `json:"when,omitempty"`    // JavaScript expression to run the step
 	CanceledExitCode int
 	AllowParallel    bool
-	DisableLog       bool `json:"disableLog"`
+	Queue            string         `json:"queue,omitempty"`
+	Priority         int            `json:"priority,omitempty"` // higher is dequeued first
+	DisableLog       bool           `json:"disableLog"`
+	Retry            *RetryConfig   `json:"retry,omitempty"`
+	Timeout          time.Duration  `json:"timeout,omitempty"`
+	StopSignal       string         `json:"stopSignal,omitempty" yaml:"stopSignal"`           // sent to the process group on stop (default: SIGTERM)
+	StopGracePeriod  time.Duration  `json:"stopGracePeriod,omitempty" yaml:"stopGracePeriod"` // SIGKILL after this period
+	Limits           *LimitsConfig  `json:"limits,omitempty"`                                 // resource limits of the shell command
+	OnInterrupted    string         `json:"onInterrupted,omitempty" yaml:"onInterrupted"`     // "restart" or "resume"
+	Approval         bool           `json:"approval,omitempty"`                               // wait for approval before running
+	ApprovalTimeout  time.Duration  `json:"approvalTimeout,omitempty" yaml:"approvalTimeout"` // reject if not approved in time
+	Notify           *NotifyConfig  `json:"notify,omitempty"`
+	Webhook          *WebhookConfig `json:"webhook,omitempty"`
 
 	Sequential bool
 	Steps      []*TaskConfig `json:"steps"`
@@ -34,8 +52,43 @@ type TaskConfig struct {
 type TaskResult struct {
 	Success  bool
 	Canceled bool
+	TimedOut bool
+	ExitCode int
 	Result   map[string]any
 	Message  string
+	Signal   string // the signal which stopped the command
+
+	PeakMemory int64 // bytes
+	CPUTime    time.Duration
+}
+
+type RetryConfig struct {
+	MaxAttempts int           `json:"maxAttempts" yaml:"maxAttempts"`
+	Interval    time.Duration `json:"interval"`
+	Backoff     string        `json:"backoff"` // "fixed" or "exponential"
+	MaxInterval time.Duration `json:"maxInterval" yaml:"maxInterval"`
+	ExitCodes   []int         `json:"exitCodes" yaml:"exitCodes"` // retry only on these codes if not empty
+}
+
+func (rc *RetryConfig) ShouldRetry(attempt int, result *TaskResult) bool {
+	if rc == nil || result == nil || result.Success || result.Canceled || attempt >= rc.MaxAttempts {
+		return false
+	}
+	return len(rc.ExitCodes) == 0 || slices.Contains(rc.ExitCodes, result.ExitCode)
+}
+
+// Delay returns the wait time before the next attempt.
+func (rc *RetryConfig) Delay(attempt int) time.Duration {
+	d := rc.Interval
+	if rc.Backoff == "exponential" {
+		for i := 1; i < attempt && (rc.MaxInterval == 0 || d < rc.MaxInterval); i++ {
+			d *= 2
+		}
+	}
+	if rc.MaxInterval > 0 && d > rc.MaxInterval {
+		d = rc.MaxInterval
+	}
+	return d
 }
 
 func (conf *TaskConfig) FixDependencies() {
@@ -51,6 +104,123 @@ func (conf *TaskConfig) FixDependencies() {
 	}
 }
 
+type ValidationError struct {
+	Errors []string `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid task: " + strings.Join(e.Errors, ", ")
+}
+
+// Validate checks the task graph for unknown dependencies, duplicate step names and cycles.
+func (conf *TaskConfig) Validate() error {
+	var errs []string
+	conf.validate("", &errs)
+	if _, ok := stopSignals[conf.StopSignal]; conf.StopSignal != "" && !ok {
+		errs = append(errs, fmt.Sprintf("unknown stop signal: %s", conf.StopSignal))
+	}
+	if err := conf.Limits.Validate(); err != nil {
+		errs = append(errs, fmt.Sprintf("invalid limits: %v", err))
+	}
+	if conf.Webhook != nil {
+		for _, name := range slices.Sorted(maps.Keys(conf.Webhook.Params)) {
+			if !conf.declares(name) {
+				errs = append(errs, fmt.Sprintf("webhook param is not declared in variables: %s", name))
+			}
+		}
+	}
+	if conf.Notify != nil {
+		for _, on := range conf.Notify.On {
+			if on != "success" && on != "failure" && on != "canceled" {
+				errs = append(errs, fmt.Sprintf("unknown notify event: %s", on))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// declares reports whether the task or its steps have the variable. Only the declared variables can be set by the params.
+func (conf *TaskConfig) declares(name string) bool {
+	if _, ok := conf.Variables[name]; ok {
+		return true
+	}
+	for _, t := range conf.Steps {
+		if t.declares(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *TaskConfig) validate(prefix string, errs *[]string) {
+	steps := map[string]*TaskConfig{}
+	for _, t := range conf.Steps {
+		if t.Name == "" {
+			*errs = append(*errs, fmt.Sprintf("%sstep name is empty", prefix))
+		} else if steps[t.Name] != nil {
+			*errs = append(*errs, fmt.Sprintf("duplicate step name: %s%s", prefix, t.Name))
+		}
+		steps[t.Name] = t
+	}
+	for _, t := range conf.Steps {
+		switch t.Trigger {
+		case "", TriggerAllSuccess, TriggerAllDone, TriggerOneFailed, TriggerAlways:
+		default:
+			*errs = append(*errs, fmt.Sprintf("unknown trigger: %s%s %s", prefix, t.Name, t.Trigger))
+		}
+		if _, ok := stopSignals[t.StopSignal]; t.StopSignal != "" && !ok {
+			*errs = append(*errs, fmt.Sprintf("unknown stop signal: %s%s %s", prefix, t.Name, t.StopSignal))
+		}
+		if err := t.Limits.Validate(); err != nil {
+			*errs = append(*errs, fmt.Sprintf("invalid limits: %s%s %v", prefix, t.Name, err))
+		}
+		if t.When != "" {
+			if _, err := goja.Compile("", t.When, false); err != nil {
+				*errs = append(*errs, fmt.Sprintf("invalid condition: %s%s %v", prefix, t.Name, err))
+			}
+		}
+		for _, d := range t.Depends {
+			if steps[d] == nil {
+				*errs = append(*errs, fmt.Sprintf("unknown dependency: %s%s depends on %s", prefix, t.Name, d))
+			}
+		}
+	}
+
+	// detect cycles
+	const visiting, visited = 1, 2
+	marks := map[string]int{}
+	var path []string
+	var visit func(name string)
+	visit = func(name string) {
+		t := steps[name]
+		if t == nil || marks[name] == visited {
+			return
+		}
+		if marks[name] == visiting {
+			cycle := append(slices.Clone(path[slices.Index(path, name):]), name)
+			*errs = append(*errs, fmt.Sprintf("dependency cycle: %s%s", prefix, strings.Join(cycle, " -> ")))
+			return
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, d := range t.Depends {
+			visit(d)
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+	}
+	for _, t := range conf.Steps {
+		visit(t.Name)
+	}
+
+	for _, t := range conf.Steps {
+		t.validate(prefix+t.Name+".", errs)
+	}
+}
+
 func (c *TaskConfig) Run(ctx context.Context, params map[string]any, log io.Writer) *TaskResult {
 	if c.Runtime == "js" {
 		return RunJs(ctx, c, params, log)
@@ -128,7 +298,17 @@ func (m *Manager) loadJs(taskId string, task *TaskConfig) error {
 	return err
 }
 
+var ErrInvalidTaskID = errors.New("invalid task id")
+
+// ValidTaskID reports whether the id can be used as a file name in the tasks and logs directories.
+func ValidTaskID(id string) bool {
+	return id != "" && id[0] != '.' && !strings.ContainsAny(id, `/\`) && !strings.Contains(id, "..") && filepath.Base(id) == id
+}
+
 func (m *Manager) Load(taskId string) (*TaskConfig, error) {
+	if !ValidTaskID(taskId) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTaskID, taskId)
+	}
 	var task TaskConfig
 	task.Dir = m.tasksDir
 	task.Name = taskId
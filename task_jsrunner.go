@@ -69,22 +69,28 @@ func StartJsTask(path string) (instance *JsTaskInstance, err error) {
 	return nil, fmt.Errorf("no entry point")
 }
 
-func (l *JsTaskInstance) Execute(params any) (result map[string]any, success bool) {
+func (l *JsTaskInstance) Execute(ctx context.Context, params any) (result map[string]any, success bool) {
 	data := map[string]any{
 		"env":     l.Env,
 		"event":   params,
 		"context": l.context,
 	}
-	ch := make(chan struct{})
+	type ret struct {
+		result  map[string]any
+		success bool
+	}
+	ch := make(chan ret, 1)
 	l.runner.RunOnLoop(func(vm *goja.Runtime) {
 		l.f(goja.Undefined(), vm.ToValue(func(r map[string]any, ok bool) {
-			result = r
-			success = ok
-			close(ch)
+			ch <- ret{r, ok}
 		}), vm.ToValue(data))
 	})
-	<-ch
-	return
+	select {
+	case r := <-ch:
+		return r.result, r.success
+	case <-ctx.Done():
+		return map[string]any{"error": context.Cause(ctx).Error()}, false
+	}
 }
 
 func (l *JsTaskInstance) Wait() {
@@ -106,7 +112,7 @@ func RunJs(ctx context.Context, config *TaskConfig, params map[string]any, log i
 		for n, v := range config.Env {
 			s.Env[n] = v
 		}
-		ret, ok := s.Execute(params)
+		ret, ok := s.Execute(ctx, params)
 		if log != nil {
 			fmt.Fprintln(log, ret)
 		}
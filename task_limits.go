@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCgroupDir is the parent cgroup (v2) of the shell steps with limits. It can be changed by GOTASK_CGROUP_DIR (empty to disable).
+const DefaultCgroupDir = "/sys/fs/cgroup/gotask"
+
+type LimitsConfig struct {
+	Memory    string        `json:"memory,omitempty"` // e.g. "512M"
+	CPUTime   time.Duration `json:"cpuTime,omitempty" yaml:"cpuTime"`
+	OpenFiles int           `json:"openFiles,omitempty" yaml:"openFiles"`
+	Processes int           `json:"processes,omitempty"`
+}
+
+// parseSize parses the size in bytes with an optional K, M or G suffix.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(size)), "B")
+	unit := int64(1)
+	if p := strings.IndexAny(s, "KMG"); p > 0 && p == len(s)-1 {
+		unit = 1 << (10 * (strings.IndexByte("KMG", s[p]) + 1))
+		s = s[:p]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size: %s", size)
+	}
+	return n * unit, nil
+}
+
+func (l *LimitsConfig) Validate() error {
+	if l == nil {
+		return nil
+	}
+	if l.Memory != "" {
+		if _, err := parseSize(l.Memory); err != nil {
+			return err
+		}
+	}
+	if l.CPUTime < 0 || l.OpenFiles < 0 || l.Processes < 0 {
+		return errors.New("negative limit")
+	}
+	return nil
+}
+
+func (l *LimitsConfig) memory() int64 {
+	n, _ := parseSize(l.Memory)
+	return n
+}
+
+// ulimitCommand returns the command prefixed with ulimit to setrlimit in the shell.
+// Memory and processes are limited by cgroup if available since RLIMIT_AS and RLIMIT_NPROC are not accurate.
+func (l *LimitsConfig) ulimitCommand(command string, cgroup bool) string {
+	var args []string
+	if l.CPUTime > 0 {
+		args = append(args, "-t", fmt.Sprint(int64(math.Ceil(l.CPUTime.Seconds()))))
+	}
+	if l.OpenFiles > 0 {
+		args = append(args, "-n", fmt.Sprint(l.OpenFiles))
+	}
+	if l.Processes > 0 && !cgroup {
+		args = append(args, "-u", fmt.Sprint(l.Processes))
+	}
+	if l.Memory != "" && !cgroup {
+		args = append(args, "-v", fmt.Sprint(l.memory()/1024))
+	}
+	if len(args) == 0 {
+		return command
+	}
+	return "ulimit " + strings.Join(args, " ") + " || exit\n" + command
+}
+
+var cgroupOnce sync.Once
+var cgroupParent string // empty if cgroup v2 is not writable
+
+func cgroupParentDir() string {
+	cgroupOnce.Do(func() {
+		dir, ok := os.LookupEnv("GOTASK_CGROUP_DIR")
+		if !ok {
+			dir = DefaultCgroupDir
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "cgroup.controllers")); dir == "" || err != nil {
+			return // not cgroup v2
+		}
+		if err := os.Mkdir(dir, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return
+		}
+		// fails if the controllers are not delegated to dir.
+		if writeFile(filepath.Join(dir, "cgroup.subtree_control"), "+memory +pids") != nil {
+			return
+		}
+		cgroupParent = dir
+	})
+	return cgroupParent
+}
+
+// stepCgroup is a cgroup for a run of the shell step.
+type stepCgroup struct {
+	dir string
+	fd  *os.File
+}
+
+// newStepCgroup returns nil if the limits don't need cgroup or cgroup is not available.
+func newStepCgroup(l *LimitsConfig) *stepCgroup {
+	if l == nil || l.Memory == "" && l.Processes == 0 || cgroupParentDir() == "" {
+		return nil
+	}
+	dir, err := os.MkdirTemp(cgroupParentDir(), "step_")
+	if err != nil {
+		return nil
+	}
+	cg := &stepCgroup{dir: dir}
+	if l.Memory != "" {
+		err = cg.write("memory.max", fmt.Sprint(l.memory()))
+	}
+	if l.Processes > 0 && err == nil {
+		err = cg.write("pids.max", fmt.Sprint(l.Processes))
+	}
+	if err == nil {
+		cg.fd, err = os.Open(dir)
+	}
+	if err != nil {
+		cg.close()
+		return nil
+	}
+	return cg
+}
+
+// writeFile writes to the existing file. (cgroup interface files)
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (cg *stepCgroup) write(name, value string) error {
+	return writeFile(filepath.Join(cg.dir, name), value)
+}
+
+func (cg *stepCgroup) read(name string) int64 {
+	b, _ := os.ReadFile(filepath.Join(cg.dir, name))
+	n, _ := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	return n
+}
+
+// stat returns the value of the key in the flat keyed file. e.g. cpu.stat
+func (cg *stepCgroup) stat(name, key string) int64 {
+	f, err := os.Open(filepath.Join(cg.dir, name))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if k, v, _ := strings.Cut(scanner.Text(), " "); k == key {
+			n, _ := strconv.ParseInt(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// setResult updates the usage of the result by the stats of the cgroup.
+func (cg *stepCgroup) setResult(r *TaskResult) {
+	if peak := cg.read("memory.peak"); peak > 0 {
+		r.PeakMemory = peak
+	}
+	if usec := cg.stat("cpu.stat", "usage_usec"); usec > 0 {
+		r.CPUTime = time.Duration(usec) * time.Microsecond
+	}
+	if !r.Success && cg.stat("memory.events", "oom_kill") > 0 {
+		r.Message = "out of memory"
+	}
+}
+
+func (cg *stepCgroup) close() {
+	if cg.fd != nil {
+		cg.fd.Close()
+	}
+	os.Remove(cg.dir)
+}
@@ -1,16 +1,153 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
+const maxOutputSize = 65536
+
+// paramString formats the param as the value of the environment variable. Objects and arrays are formatted as JSON.
+func paramString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case map[string]any, []any:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// DefaultStopGracePeriod is the waiting time after the stop signal before killing the canceled command.
+const DefaultStopGracePeriod = 3 * time.Second
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+func signalName(sig syscall.Signal) string {
+	for name, s := range stopSignals {
+		if s == sig {
+			return name
+		}
+	}
+	return sig.String()
+}
+
+// processGroup signals all the processes started by the command including pipelines and background jobs.
+type processGroup struct {
+	cmd   *exec.Cmd
+	mutex sync.Mutex
+	sent  syscall.Signal
+	kill  *time.Timer
+}
+
+func (g *processGroup) signal(sig syscall.Signal) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.sent = sig
+	return syscall.Kill(-g.cmd.Process.Pid, sig)
+}
+
+// stop sends sig to the group and SIGKILL after the grace period.
+func (g *processGroup) stop(sig syscall.Signal, grace time.Duration) error {
+	if sig != syscall.SIGKILL {
+		g.mutex.Lock()
+		g.kill = time.AfterFunc(grace, func() { g.signal(syscall.SIGKILL) })
+		g.mutex.Unlock()
+	}
+	return g.signal(sig)
+}
+
+// waited stops the SIGKILL timer after the command is waited, unless the background jobs are still alive.
+// The pgid can be reused by another process once the group has exited.
+func (g *processGroup) waited() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.kill != nil && syscall.Kill(-g.cmd.Process.Pid, 0) != nil {
+		g.kill.Stop()
+	}
+}
+
+// endedBy returns the signal which terminated the command, or 0.
+func (g *processGroup) endedBy() syscall.Signal {
+	if ws, ok := g.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return ws.Signal()
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.sent
+}
+
+// readOutputs parses KEY=VALUE lines written to $GOTASK_OUTPUT.
+func readOutputs(path string) map[string]any {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var outputs map[string]any
+	scanner := bufio.NewScanner(io.LimitReader(f, maxOutputSize))
+	for scanner.Scan() {
+		k, v, ok := strings.Cut(scanner.Text(), "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || k[0] == '#' {
+			continue
+		}
+		if outputs == nil {
+			outputs = map[string]any{}
+		}
+		outputs[k] = v
+	}
+	return outputs
+}
+
 func RunSh(ctx context.Context, config *TaskConfig, params map[string]any, log io.Writer) *TaskResult {
 	r := &TaskResult{}
-	cmd := exec.CommandContext(ctx, "bash", "-c", config.Command)
+	command := config.Command
+	cgroup := newStepCgroup(config.Limits)
+	if cgroup != nil {
+		defer cgroup.close()
+	}
+	if config.Limits != nil {
+		command = config.Limits.ulimitCommand(command, cgroup != nil)
+	}
+	cmd := exec.CommandContext(ctx, "bash", "-c", command)
+	sig := syscall.SIGTERM
+	if config.StopSignal != "" {
+		sig = stopSignals[config.StopSignal]
+	}
+	grace := config.StopGracePeriod
+	if grace <= 0 {
+		grace = DefaultStopGracePeriod
+	}
+	group := &processGroup{cmd: cmd}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if cgroup != nil {
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgroup.fd.Fd())
+	}
+	cmd.Cancel = func() error { return group.stop(sig, grace) }
+	cmd.WaitDelay = grace
 	cmd.Dir = config.Dir
 	cmd.Env = os.Environ()
 	if log != nil {
@@ -21,15 +158,43 @@ func RunSh(ctx context.Context, config *TaskConfig, params map[string]any, log i
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", n, v))
 	}
 	for n, v := range params {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%v", n, v))
+		cmd.Env = append(cmd.Env, n+"="+paramString(v))
+	}
+	var outputPath string
+	if out, err := os.CreateTemp("", "gotask_output_*"); err == nil {
+		out.Close()
+		outputPath = out.Name()
+		defer os.Remove(outputPath)
+		cmd.Env = append(cmd.Env, "GOTASK_OUTPUT="+outputPath)
+	}
+	err := cmd.Run()
+	if cmd.Process != nil {
+		group.waited()
 	}
-	_ = cmd.Run()
 	code := cmd.ProcessState.ExitCode()
+	if outputPath != "" {
+		r.Result = readOutputs(outputPath)
+	}
 
+	r.ExitCode = code
 	r.Success = code == 0
 	r.Canceled = code != 0 && code == config.CanceledExitCode
-	if !r.Success {
+	if cmd.ProcessState == nil {
+		r.Message = err.Error()
+	} else if sig := group.endedBy(); sig != 0 && !r.Success {
+		r.Signal = signalName(sig)
+		r.Message = "stopped by " + r.Signal
+	} else if !r.Success {
 		r.Message = "command exited with code " + fmt.Sprint(code)
 	}
+	if ps := cmd.ProcessState; ps != nil {
+		r.CPUTime = ps.UserTime() + ps.SystemTime()
+		if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+			r.PeakMemory = ru.Maxrss * 1024
+		}
+	}
+	if cgroup != nil {
+		cgroup.setResult(r)
+	}
 	return r
 }
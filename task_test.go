@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTaskConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []*TaskConfig
+		errors int
+	}{
+		{"valid", []*TaskConfig{{Name: "a"}, {Name: "b", Depends: []string{"a"}}}, 0},
+		{"unknown", []*TaskConfig{{Name: "a"}, {Name: "b", Depends: []string{"x"}}}, 1},
+		{"duplicate", []*TaskConfig{{Name: "a"}, {Name: "a"}}, 1},
+		{"cycle", []*TaskConfig{{Name: "a", Depends: []string{"c"}}, {Name: "b", Depends: []string{"a"}}, {Name: "c", Depends: []string{"b"}}}, 1},
+		{"self", []*TaskConfig{{Name: "a", Depends: []string{"a"}}}, 1},
+		{"nested", []*TaskConfig{{Name: "a", Steps: []*TaskConfig{{Name: "x", Depends: []string{"y"}}}}}, 1},
+		{"signal", []*TaskConfig{{Name: "a", StopSignal: "SIGFOO"}}, 1},
+	}
+	for _, tt := range tests {
+		conf := &TaskConfig{Name: "test", Steps: tt.steps}
+		err := conf.Validate()
+		var verr *ValidationError
+		if tt.errors == 0 {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+		} else if !errors.As(err, &verr) || len(verr.Errors) != tt.errors {
+			t.Errorf("%s: expected %d errors: %v", tt.name, tt.errors, err)
+		}
+	}
+}
+
+func TestManager_LoadInvalidID(t *testing.T) {
+	m := NewManager(&ManagerConfig{TasksDir: t.TempDir()})
+	for _, id := range []string{"", ".", "..", "../../tmp/evil", "a/b", `a\b`, "a..b"} {
+		if _, err := m.Load(id); !errors.Is(err, ErrInvalidTaskID) {
+			t.Errorf("%q should be rejected: %v", id, err)
+		}
+	}
+	if ValidTaskID("deploy-prod.v2") != true {
+		t.Error("deploy-prod.v2 should be valid")
+	}
+}
+
+func TestRunSh_Stop(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "marker")
+	tests := []struct {
+		name    string
+		config  *TaskConfig
+		message string
+	}{
+		{"term", &TaskConfig{Command: "(sleep 0.5; touch " + marker + ") & sleep 10"}, "stopped by SIGTERM"},
+		{"kill", &TaskConfig{Command: "trap '' TERM; (sleep 0.5; touch " + marker + ") & sleep 10", StopGracePeriod: 100 * time.Millisecond}, "stopped by SIGKILL"},
+		{"signal", &TaskConfig{Command: "sleep 10 | cat", StopSignal: "SIGHUP"}, "stopped by SIGHUP"},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		result := RunSh(ctx, tt.config, nil, nil)
+		cancel()
+		if result.Success || result.Message != tt.message {
+			t.Errorf("%s: unexpected result: %v %s", tt.name, result.Success, result.Message)
+		}
+	}
+	time.Sleep(time.Second)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("background process should be stopped")
+	}
+}
+
+func TestRunSh_Limits(t *testing.T) {
+	var out bytes.Buffer
+	config := &TaskConfig{Command: "ulimit -n; ulimit -t; head -c 10000000 /dev/zero | tail -c 1 >/dev/null", Limits: &LimitsConfig{OpenFiles: 64, CPUTime: 1500 * time.Millisecond}}
+	result := RunSh(context.Background(), config, nil, &out)
+	if !result.Success || out.String() != "64\n2\n" {
+		t.Errorf("unexpected result: %v %q", result.Success, out.String())
+	}
+	if result.PeakMemory <= 0 {
+		t.Errorf("peak memory should be reported: %d", result.PeakMemory)
+	}
+
+	sizes := map[string]int64{"512M": 512 << 20, "1g": 1 << 30, "100KB": 100 << 10, "4096": 4096, "x": 0, "-1M": 0}
+	for s, expected := range sizes {
+		if n, _ := parseSize(s); n != expected {
+			t.Errorf("parseSize(%s) = %d", s, n)
+		}
+	}
+}
+
+func TestRunSh_Params(t *testing.T) {
+	var params map[string]any
+	dec := json.NewDecoder(strings.NewReader(`{"N": 1000000, "F": 0.5, "BIG": 12345678901234567890, "O": {"a": [1, 2]}}`))
+	dec.UseNumber()
+	if err := dec.Decode(&params); err != nil {
+		t.Fatal(err)
+	}
+	normalizeNumbers(params)
+	if _, ok := params["N"].(int64); !ok {
+		t.Errorf("should be int64: %T", params["N"])
+	}
+	var out bytes.Buffer
+	result := RunSh(context.Background(), &TaskConfig{Command: `echo "$N $F $BIG $O"`}, params, &out)
+	if !result.Success || out.String() != "1000000 0.5 12345678901234567890 {\"a\":[1,2]}\n" {
+		t.Errorf("unexpected env: %q", out.String())
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	params := map[string]any{"COUNT": int64(5), "ENV": "prod"}
+	tests := []struct {
+		expr     string
+		expected bool
+		err      bool
+	}{
+		{"COUNT > 3", true, false},
+		{"ENV == 'dev'", false, false},
+		{"COUNT >", false, true},
+		{"while(true){}", false, true},
+	}
+	for _, tt := range tests {
+		ok, err := EvalCondition(tt.expr, params)
+		if ok != tt.expected || (err != nil) != tt.err {
+			t.Errorf("%s: %v %v", tt.expr, ok, err)
+		}
+	}
+}
+
+func TestProcessGroup_Stop(t *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	group := &processGroup{cmd: cmd}
+	group.stop(syscall.SIGTERM, time.Second)
+	cmd.Wait()
+	group.waited()
+	if group.endedBy() != syscall.SIGTERM {
+		t.Errorf("should be stopped by SIGTERM: %v", group.endedBy())
+	}
+	if group.kill.Stop() {
+		t.Error("SIGKILL timer should be stopped after the group exited")
+	}
+}
+
+func TestRetryConfig(t *testing.T) {
+	rc := &RetryConfig{MaxAttempts: 3, ExitCodes: []int{1, 75}}
+	retries := []struct {
+		attempt int
+		result  *TaskResult
+		retry   bool
+	}{
+		{1, &TaskResult{ExitCode: 1}, true},
+		{2, &TaskResult{ExitCode: 75}, true},
+		{3, &TaskResult{ExitCode: 1}, false},
+		{1, &TaskResult{ExitCode: 2}, false},
+		{1, &TaskResult{Success: true}, false},
+		{1, &TaskResult{ExitCode: 1, Canceled: true}, false},
+		{1, nil, false},
+	}
+	for _, tt := range retries {
+		if rc.ShouldRetry(tt.attempt, tt.result) != tt.retry {
+			t.Errorf("attempt %d %+v: should be %v", tt.attempt, tt.result, tt.retry)
+		}
+	}
+	if (*RetryConfig)(nil).ShouldRetry(1, &TaskResult{}) || !(&RetryConfig{MaxAttempts: 2}).ShouldRetry(1, &TaskResult{ExitCode: 2}) {
+		t.Error("exit codes should not be filtered if empty")
+	}
+
+	delays := []struct {
+		rc      *RetryConfig
+		attempt int
+		delay   time.Duration
+	}{
+		{&RetryConfig{Interval: time.Second}, 3, time.Second},
+		{&RetryConfig{Interval: time.Second, Backoff: "exponential"}, 1, time.Second},
+		{&RetryConfig{Interval: time.Second, Backoff: "exponential"}, 4, 8 * time.Second},
+		{&RetryConfig{Interval: time.Second, Backoff: "exponential", MaxInterval: 5 * time.Second}, 4, 5 * time.Second},
+		{&RetryConfig{Interval: time.Second, Backoff: "exponential", MaxInterval: 5 * time.Second}, 100, 5 * time.Second},
+		{&RetryConfig{Interval: 10 * time.Second, MaxInterval: 5 * time.Second}, 1, 5 * time.Second},
+	}
+	for _, tt := range delays {
+		if d := tt.rc.Delay(tt.attempt); d != tt.delay {
+			t.Errorf("%+v attempt %d: %v != %v", tt.rc, tt.attempt, d, tt.delay)
+		}
+	}
+}
+
+func TestTriggered(t *testing.T) {
+	deps := func(statuses ...string) []*TaskState {
+		var states []*TaskState
+		for _, s := range statuses {
+			states = append(states, &TaskState{Status: s})
+		}
+		return states
+	}
+	tests := []struct {
+		trigger string
+		deps    []*TaskState
+		run     bool
+		status  string
+	}{
+		{"", deps("success", "skipped"), true, ""},
+		{"", deps("success", "running"), false, ""},
+		{"", deps("success", "failed"), false, "upstream_failed"},
+		{"", deps("upstream_failed"), false, "upstream_failed"},
+		{TriggerAllSuccess, deps("canceled"), false, "upstream_failed"},
+		{TriggerAllDone, deps("failed", "skipped"), true, ""},
+		{TriggerAllDone, deps("failed", "queued"), false, ""},
+		{TriggerOneFailed, deps("success", "failed"), true, ""},
+		{TriggerOneFailed, deps("success", "skipped"), false, "skipped"},
+		{TriggerOneFailed, deps("timeout"), true, ""},
+		{TriggerAlways, deps("canceled", "upstream_failed"), true, ""},
+		{TriggerAlways, nil, true, ""},
+	}
+	for _, tt := range tests {
+		run, status := triggered(tt.trigger, tt.deps)
+		if run != tt.run || status != tt.status {
+			var statuses []string
+			for _, d := range tt.deps {
+				statuses = append(statuses, d.Status)
+			}
+			t.Errorf("%s %v: %v %q", tt.trigger, statuses, run, status)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrNotWaitingApproval = errors.New("step is not waiting for approval")
+
+type ApprovalState struct {
+	Approved bool   `json:"approved"`
+	By       string `json:"by,omitempty"`
+	At       int64  `json:"at"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// waitApproval blocks until the step is approved. It returns false if the step should not be run.
+func (state *runState) waitApproval(ctx context.Context, r *Runner) bool {
+	ch := make(chan *ApprovalState, 1)
+	r.mutex.Lock()
+	r.approvals[state.task] = ch
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.approvals, state.task)
+		r.mutex.Unlock()
+	}()
+
+	state.setStatus("waiting_approval", true)
+	r.updated(state.log)
+
+	var timeout <-chan time.Time
+	if state.config.ApprovalTimeout > 0 {
+		timer := time.NewTimer(state.config.ApprovalTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var approval *ApprovalState
+	select {
+	case approval = <-ch:
+	case <-timeout:
+		approval = &ApprovalState{At: time.Now().UnixMilli(), Comment: "approval timed out"}
+	case <-ctx.Done():
+		state.finish(ctxStatus(ctx), "")
+		return false
+	}
+	state.lock()
+	state.task.Approval = approval
+	if !approval.Approved {
+		state.task.FinishedAt = approval.At
+		state.task.Status = "rejected"
+		state.task.Message = approval.Comment
+		if approval.By != "" {
+			state.task.Message = strings.TrimSpace("rejected by " + approval.By + ": " + approval.Comment)
+		}
+		state.unlock()
+		return false
+	}
+	state.task.Status = "queued"
+	state.unlock()
+	r.updated(state.log)
+	return true
+}
+
+// Approve approves or rejects the step waiting for approval. step is the name of the step (e.g. "deploy" or "release.deploy"), or empty for the task itself.
+func (r *Runner) Approve(taskID string, runID int64, step string, approval *ApprovalState) error {
+	state := r.getRunningTask(taskID, runID)
+	if state == nil {
+		return ErrRunNotFound
+	}
+	ts := state.task
+	if step != "" {
+		state.lock()
+		for _, name := range strings.Split(step, ".") {
+			if ts = findTaskLog(ts.Steps, name); ts == nil {
+				break
+			}
+		}
+		state.unlock()
+		if ts == nil {
+			return fmt.Errorf("%w: %s", ErrStepNotFound, step)
+		}
+	}
+	r.mutex.Lock()
+	ch := r.approvals[ts]
+	delete(r.approvals, ts)
+	r.mutex.Unlock()
+	if ch == nil {
+		return ErrNotWaitingApproval
+	}
+	approval.At = time.Now().UnixMilli()
+	ch <- approval
+	return nil
+}
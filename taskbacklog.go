@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const backlogInterval = time.Second
+
+// backlogEntry is a run waiting for the queues to have space.
+type backlogEntry struct {
+	Config *TaskConfig `json:"config"`
+	Log    *LogEntry   `json:"log"`
+
+	launching bool // removed by addTask when the run is registered
+}
+
+func (b *backlogEntry) queueName() string {
+	if b.Config.Queue != "" {
+		return b.Config.Queue
+	}
+	return DefaultQueue
+}
+
+func (r *Runner) backlogPath() string {
+	return filepath.Join(r.logDir, "_backlog.json")
+}
+
+func (r *Runner) loadBacklog() {
+	bytes, err := os.ReadFile(r.backlogPath())
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	json.Unmarshal(bytes, &r.backlog)
+}
+
+// saveBacklog writes the backlog to the file. r.mutex must be held.
+func (r *Runner) saveBacklog() {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+	json, err := json.Marshal(r.backlog)
+	if err != nil {
+		return
+	}
+	path := r.backlogPath()
+	_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if os.WriteFile(path+".tmp", json, 0600) == nil {
+		os.Rename(path+".tmp", path)
+	}
+}
+
+func (r *Runner) addBacklog(config *TaskConfig, log *LogEntry) {
+	log.Task.Status = "backlog"
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.backlog = append(r.backlog, &backlogEntry{Config: config, Log: log})
+	r.saveBacklog()
+}
+
+func (r *Runner) cancelBacklog(taskID string, runID int64) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, b := range r.backlog {
+		if b.Log.TaskID == taskID && b.Log.RunID == runID && !b.launching {
+			r.backlog = append(r.backlog[:i], r.backlog[i+1:]...)
+			r.saveBacklog()
+			b.Log.Task.Status = "canceled"
+			b.Log.Task.FinishedAt = time.Now().UnixMilli()
+			go r.appendLog(b.Log)
+			return true
+		}
+	}
+	return false
+}
+
+// queueNames adds the names of the queues used by the task.
+func queueNames(config *TaskConfig, queue string, names map[string]bool) {
+	if config.Queue != "" {
+		queue = config.Queue
+	}
+	if len(config.Steps) == 0 {
+		names[queue] = true
+	}
+	for _, t := range config.Steps {
+		queueNames(t, queue, names)
+	}
+}
+
+// startBacklog starts the runs in the backlog as many as their queues have space.
+// The steps are posted after the launch, so the space is reserved for each run instead of checking the queues again.
+func (r *Runner) startBacklog() {
+	r.mutex.Lock()
+	if r.shutdown {
+		// keep them on the disk for the next process.
+		r.mutex.Unlock()
+		return
+	}
+	space := map[string]int{}
+	var starts []*backlogEntry
+	for _, b := range r.backlog {
+		if b.launching {
+			continue
+		}
+		names := map[string]bool{}
+		queueNames(b.Config, DefaultQueue, names)
+		ok := true
+		for name := range names {
+			if _, exists := space[name]; !exists {
+				space[name] = math.MaxInt
+				if q := r.queues[name]; q != nil {
+					space[name] = q.Space()
+				}
+			}
+			ok = ok && space[name] > 0
+		}
+		if !ok {
+			continue
+		}
+		for name := range names {
+			space[name]--
+		}
+		b.launching = true
+		starts = append(starts, b)
+	}
+	r.mutex.Unlock()
+
+	for _, b := range starts {
+		r.launch(b.Config, b.Log)
+	}
+}
+
+func (r *Runner) drainBacklog(ctx context.Context) {
+	ticker := time.NewTicker(backlogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.startBacklog()
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNotPaused = errors.New("run is not paused")
+var ErrNotPausable = errors.New("run without steps can't be paused")
+
+// pauseCh returns a channel closed when the run is resumed, or nil if the run is not paused.
+func (r *Runner) pauseCh(log *LogEntry) <-chan struct{} {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if ch := r.pausedRuns[log]; ch != nil {
+		return ch
+	}
+	return r.pausedAll
+}
+
+// waitResumed blocks while the run is paused. It returns false if ctx is done.
+func (r *Runner) waitResumed(ctx context.Context, log *LogEntry) bool {
+	for {
+		ch := r.pauseCh(log)
+		if ch == nil {
+			return true
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// refreshPaused updates the status of the run according to the pause state.
+func (r *Runner) refreshPaused(state *runState) {
+	paused := r.pauseCh(state.log) != nil
+	state.lock()
+	changed := true
+	// the command of the run without steps can't be held once started.
+	if paused && state.task.Status == "running" && len(state.config.Steps) > 0 {
+		state.task.Status = "paused"
+	} else if !paused && state.task.Status == "paused" {
+		state.task.Status = "running"
+	} else {
+		changed = false
+	}
+	state.unlock()
+	if changed {
+		r.updated(state.log)
+	}
+}
+
+// Pause stops launching new steps of the run. The running steps are not stopped.
+func (r *Runner) Pause(taskID string, runID int64) error {
+	state := r.getRunningTask(taskID, runID)
+	if state == nil {
+		return ErrRunNotFound
+	}
+	if len(state.config.Steps) == 0 {
+		return ErrNotPausable
+	}
+	r.mutex.Lock()
+	if r.pausedRuns[state.log] == nil {
+		r.pausedRuns[state.log] = make(chan struct{})
+	}
+	r.mutex.Unlock()
+	r.refreshPaused(state)
+	return nil
+}
+
+// Resume continues the paused run.
+func (r *Runner) Resume(taskID string, runID int64) error {
+	state := r.getRunningTask(taskID, runID)
+	if state == nil {
+		return ErrRunNotFound
+	}
+	r.mutex.Lock()
+	ch := r.pausedRuns[state.log]
+	delete(r.pausedRuns, state.log)
+	r.mutex.Unlock()
+	if ch == nil {
+		return ErrNotPaused
+	}
+	close(ch)
+	r.refreshPaused(state)
+	return nil
+}
+
+// PauseAll pauses all the runs including the runs started later. (e.g. to drain the server for upgrades)
+func (r *Runner) PauseAll() {
+	r.mutex.Lock()
+	if r.pausedAll == nil {
+		r.pausedAll = make(chan struct{})
+	}
+	runnings := append([]*runState{}, r.runnings...)
+	r.mutex.Unlock()
+	for _, state := range runnings {
+		r.refreshPaused(state)
+	}
+}
+
+// ResumeAll cancels PauseAll. The runs paused by Pause are not resumed.
+func (r *Runner) ResumeAll() {
+	r.mutex.Lock()
+	if r.pausedAll != nil {
+		close(r.pausedAll)
+		r.pausedAll = nil
+	}
+	runnings := append([]*runState{}, r.runnings...)
+	r.mutex.Unlock()
+	for _, state := range runnings {
+		r.refreshPaused(state)
+	}
+}
+
+func (r *Runner) Paused() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.pausedAll != nil
+}
@@ -1,34 +1,75 @@
 package main
 
 import (
+	"container/heap"
 	"context"
+	"slices"
+	"sort"
 	"sync"
+	"time"
 )
 
+// DefaultQueueAging is the waiting time to raise the priority of a pending entry by 1.
+const DefaultQueueAging = time.Minute
+
 type Task interface {
 	Run()
 }
 
 type TaskQueue struct {
 	semaphoreCh chan struct{}
-	taskCh      chan Task
+	notifyCh    chan struct{}
+	queueLen    int
+	aging       time.Duration
 	wg          sync.WaitGroup
 	mutex       sync.RWMutex
+	spaceCond   *sync.Cond
+	pending     entryHeap
 	entries     map[string]*QueueEntry
+	running     int
+	waiting     int
+	maxPending  int
+	rejected    uint64
+	seq         uint64
+	createdAt   time.Time
+}
+
+type QueueStats struct {
+	Name       string   `json:"name"`
+	Parallel   int      `json:"parallel"`
+	Size       int      `json:"size"`
+	Running    int      `json:"running"`
+	Pending    int      `json:"pending"`
+	Waiting    int      `json:"waiting"`    // blocked until the queue has space
+	MaxPending int      `json:"maxPending"` // high watermark
+	Rejected   uint64   `json:"rejected"`
+	Backlog    int      `json:"backlog"`
+	Entries    []string `json:"entries"`
 }
 
 func NewTaskQueue(parallel int, queueLen int, start bool) *TaskQueue {
 	d := &TaskQueue{
 		semaphoreCh: make(chan struct{}, parallel),
-		taskCh:      make(chan Task, queueLen),
+		notifyCh:    make(chan struct{}, 1),
+		queueLen:    queueLen,
+		aging:       DefaultQueueAging,
 		entries:     map[string]*QueueEntry{},
+		createdAt:   time.Now(),
 	}
+	d.spaceCond = sync.NewCond(&d.mutex)
 	if start {
 		d.Start(context.Background())
 	}
 	return d
 }
 
+// SetAging sets the waiting time to raise the priority of pending entries by 1. 0 disables aging.
+func (d *TaskQueue) SetAging(aging time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.aging = aging
+}
+
 func (d *TaskQueue) Start(ctx context.Context) {
 	d.wg.Add(1)
 	go func() {
@@ -38,56 +79,193 @@ func (d *TaskQueue) Start(ctx context.Context) {
 			case <-ctx.Done():
 				return
 			case d.semaphoreCh <- struct{}{}:
+			}
+			task := d.pop()
+			for task == nil {
 				select {
 				case <-ctx.Done():
 					<-d.semaphoreCh
 					return
-				case task := <-d.taskCh:
-					d.wg.Add(1)
-
-					go func() {
-						defer d.wg.Done()
-						defer func() { <-d.semaphoreCh }()
-						task.Run()
-					}()
+				case <-d.notifyCh:
+					task = d.pop()
 				}
 			}
+			d.wg.Add(1)
+
+			go func() {
+				defer d.wg.Done()
+				defer d.release()
+				task.Run()
+			}()
 		}
 	}()
 }
 
+func (d *TaskQueue) Stats() *QueueStats {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	stats := &QueueStats{
+		Parallel:   cap(d.semaphoreCh),
+		Size:       d.queueLen,
+		Running:    d.running,
+		Pending:    len(d.pending),
+		Waiting:    d.waiting,
+		MaxPending: d.maxPending,
+		Rejected:   d.rejected,
+	}
+	for id := range d.entries {
+		stats.Entries = append(stats.Entries, id)
+	}
+	sort.Strings(stats.Entries)
+	return stats
+}
+
+type PendingEntry struct {
+	ID       string `json:"id"`
+	Priority int    `json:"priority"`
+	Position int    `json:"position"`
+}
+
+// Pending returns the entries waiting in the queue in dequeue order.
+func (d *TaskQueue) Pending() []*PendingEntry {
+	d.mutex.RLock()
+	sorted := slices.Clone(d.pending)
+	d.mutex.RUnlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted.Less(i, j) })
+	var entries []*PendingEntry
+	for i, t := range sorted {
+		entries = append(entries, &PendingEntry{ID: t.id, Priority: t.priority, Position: i})
+	}
+	return entries
+}
+
+// Cancel removes the pending entry from the queue. Running entries can not be canceled.
+func (d *TaskQueue) Cancel(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t := d.entries[id]
+	if t == nil || t.index < 0 {
+		return false
+	}
+	heap.Remove(&d.pending, t.index)
+	delete(d.entries, id)
+	t.canceled = true
+	close(t.done)
+	d.spaceCond.Broadcast()
+	return true
+}
+
+// MoveToFront moves the pending entry to the head of the queue.
+func (d *TaskQueue) MoveToFront(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t := d.entries[id]
+	if t == nil || t.index < 0 {
+		return false
+	}
+	if t.index != 0 {
+		t.key = d.pending[0].key + 1
+		heap.Fix(&d.pending, t.index)
+	}
+	return true
+}
+
 func (d *TaskQueue) Wait() {
 	d.wg.Wait()
 }
 
 func (d *TaskQueue) PostTask(t Task, block bool) bool {
+	var ctx context.Context
 	if block {
-		d.taskCh <- t
-	} else {
-		select {
-		case d.taskCh <- t:
-		default:
-			return false
-		}
+		ctx = context.Background()
 	}
-	return true
+	_, ok := d.addTaskState(ctx, t, "", 0)
+	return ok
+}
+
+// Full reports whether a new entry will be rejected.
+func (d *TaskQueue) Full() bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return !d.hasSpace()
+}
+
+// Space returns the number of entries which can be queued now.
+func (d *TaskQueue) Space() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return max(d.queueLen-len(d.pending), cap(d.semaphoreCh)-d.running-len(d.pending), 0)
+}
+
+// hasSpace reports whether a new entry can be queued. d.mutex must be held.
+func (d *TaskQueue) hasSpace() bool {
+	return len(d.pending) < d.queueLen || d.running+len(d.pending) < cap(d.semaphoreCh)
+}
+
+func (d *TaskQueue) push(t *QueueEntry) {
+	t.seq = d.seq
+	d.seq++
+	t.key = float64(t.priority)
+	if d.aging > 0 {
+		t.key -= float64(time.Since(d.createdAt)) / float64(d.aging)
+	}
+	heap.Push(&d.pending, t)
+	d.maxPending = max(d.maxPending, len(d.pending))
+	select {
+	case d.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (d *TaskQueue) pop() *QueueEntry {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.pending) == 0 {
+		return nil
+	}
+	d.running++
+	d.spaceCond.Broadcast()
+	return heap.Pop(&d.pending).(*QueueEntry)
+}
+
+func (d *TaskQueue) release() {
+	d.mutex.Lock()
+	d.running--
+	d.spaceCond.Broadcast()
+	d.mutex.Unlock()
+	<-d.semaphoreCh
 }
 
 type QueueEntry struct {
-	task Task
-	id   string
-	done chan struct{}
-	d    *TaskQueue
+	task     Task
+	id       string
+	priority int
+	done     chan struct{}
+	d        *TaskQueue
+
+	key      float64 // priority with aging
+	seq      uint64
+	index    int // index in the heap, -1 if not pending
+	canceled bool
 }
 
 func (t *QueueEntry) ID() string {
 	return t.id
 }
 
+func (t *QueueEntry) Priority() int {
+	return t.priority
+}
+
 func (t *QueueEntry) Done() <-chan struct{} {
 	return t.done
 }
 
+// Canceled reports whether the entry is removed from the queue without running. Valid after Done.
+func (t *QueueEntry) Canceled() bool {
+	return t.canceled
+}
+
 func (t *QueueEntry) Run() {
 	defer t.finish()
 	t.task.Run()
@@ -101,36 +279,85 @@ func (t *QueueEntry) finish() {
 	delete(t.d.entries, t.ID())
 }
 
-func (d *TaskQueue) addTaskState(task Task, id string, block bool) (*QueueEntry, bool) {
-	var once sync.Once
+// entryHeap orders the entries by priority, then FIFO.
+type entryHeap []*QueueEntry
+
+func (h entryHeap) Len() int { return len(h) }
+func (h entryHeap) Less(i, j int) bool {
+	return h[i].key > h[j].key || h[i].key == h[j].key && h[i].seq < h[j].seq
+}
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *entryHeap) Push(x any) {
+	t := x.(*QueueEntry)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *entryHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
+
+// addTaskState waits until the queue has space or ctx is done. nil ctx means non-blocking.
+func (d *TaskQueue) addTaskState(ctx context.Context, task Task, id string, priority int) (*QueueEntry, bool) {
 	d.mutex.Lock()
-	defer once.Do(func() { d.mutex.Unlock() })
+	defer d.mutex.Unlock()
 
 	if t, exists := d.entries[id]; exists {
 		return t, false
 	}
-	ts := &QueueEntry{task, id, make(chan struct{}), d}
+	ts := &QueueEntry{task: task, id: id, priority: priority, done: make(chan struct{}), d: d, index: -1}
 	if id != "" {
 		d.entries[id] = ts
 	}
-	if !block {
-		if !d.PostTask(ts, block) {
-			delete(d.entries, id)
-			return nil, false
+	if !d.hasSpace() && ctx != nil {
+		stop := context.AfterFunc(ctx, func() {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			d.spaceCond.Broadcast()
+		})
+		defer stop()
+		d.waiting++
+		for !d.hasSpace() && ctx.Err() == nil {
+			d.spaceCond.Wait()
 		}
-	} else {
-		once.Do(func() { d.mutex.Unlock() })
-		d.PostTask(ts, block)
+		d.waiting--
+	}
+	if !d.hasSpace() {
+		delete(d.entries, id)
+		d.rejected++
+		return nil, false
 	}
+	d.push(ts)
 	return ts, true
 }
 
 func (d *TaskQueue) PostWithId(task Task, id string) (*QueueEntry, bool) {
-	return d.addTaskState(task, id, true)
+	return d.addTaskState(context.Background(), task, id, 0)
 }
 
 func (d *TaskQueue) TryPostWithId(task Task, id string) (*QueueEntry, bool) {
-	return d.addTaskState(task, id, false)
+	return d.addTaskState(nil, task, id, 0)
+}
+
+func (d *TaskQueue) PostWithPriority(task Task, id string, priority int) (*QueueEntry, bool) {
+	return d.addTaskState(context.Background(), task, id, priority)
+}
+
+func (d *TaskQueue) TryPostWithPriority(task Task, id string, priority int) (*QueueEntry, bool) {
+	return d.addTaskState(nil, task, id, priority)
+}
+
+// PostWithContext waits until the queue has space or ctx is done.
+func (d *TaskQueue) PostWithContext(ctx context.Context, task Task, id string, priority int) (*QueueEntry, bool) {
+	return d.addTaskState(ctx, task, id, priority)
 }
 
 type taskFunc func()
@@ -97,3 +97,91 @@ func TestTask_WaitFInish(t *testing.T) {
 		t.Error("started task is not finished")
 	}
 }
+
+func TestTask_Priority(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler := NewTaskQueue(1, 10, false)
+	scheduler.SetAging(0)
+
+	var order []string
+	post := func(id string, priority int) {
+		scheduler.TryPostWithPriority(taskFunc(func() { order = append(order, id) }), id, priority)
+	}
+	post("low1", 0)
+	post("high", 10)
+	post("low2", 0)
+	post("mid", 5)
+	last, _ := scheduler.TryPostWithPriority(taskFunc(func() {}), "last", -100)
+	scheduler.Start(ctx)
+	<-last.Done()
+
+	expected := []string{"high", "mid", "low1", "low2"}
+	if len(order) != len(expected) {
+		t.Fatalf("order: %v", order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Fatalf("order: %v", order)
+		}
+	}
+}
+
+func TestTask_PriorityAging(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler := NewTaskQueue(1, 10, false)
+	scheduler.SetAging(10 * time.Millisecond)
+
+	var order []string
+	done := make(chan struct{})
+	scheduler.TryPostWithPriority(taskFunc(func() { order = append(order, "old") }), "old", 0)
+	time.Sleep(50 * time.Millisecond) // +5
+	scheduler.TryPostWithPriority(taskFunc(func() { order = append(order, "new") }), "new", 3)
+	scheduler.TryPostWithPriority(taskFunc(func() { close(done) }), "last", -100)
+	scheduler.Start(ctx)
+	<-done
+
+	if len(order) != 2 || order[0] != "old" {
+		t.Errorf("old entry should be dequeued first: %v", order)
+	}
+}
+
+func TestTask_CancelAndMove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	scheduler := NewTaskQueue(1, 10, false)
+	scheduler.SetAging(0)
+
+	var order []string
+	for _, id := range []string{"A", "B", "C", "D"} {
+		scheduler.TryPostFunc(func() { order = append(order, id) }, id)
+	}
+	if !scheduler.Cancel("B") {
+		t.Error("failed to cancel B")
+	}
+	if !scheduler.MoveToFront("D") {
+		t.Error("failed to move D")
+	}
+	if scheduler.Cancel("X") || scheduler.MoveToFront("X") {
+		t.Error("unknown entry")
+	}
+
+	pending := scheduler.Pending()
+	expected := []string{"D", "A", "C"}
+	if len(pending) != len(expected) {
+		t.Fatalf("pending: %v", pending)
+	}
+	for i, ent := range pending {
+		if ent.ID != expected[i] || ent.Position != i {
+			t.Errorf("pending[%d]: %v", i, ent)
+		}
+	}
+
+	last, _ := scheduler.TryPostFunc(func() {}, "last")
+	scheduler.Start(ctx)
+	<-last.Done()
+	if len(order) != 3 || order[0] != "D" || order[1] != "A" || order[2] != "C" {
+		t.Errorf("order: %v", order)
+	}
+}
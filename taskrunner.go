@@ -2,22 +2,64 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var ErrTaskTimeout = errors.New("timeout")
+var ErrQueueFull = errors.New("queue is full")
+var ErrShuttingDown = errors.New("server is shutting down")
+var ErrRunNotFound = errors.New("run not found")
+var ErrStepNotFound = errors.New("step not found")
+
+const DefaultQueue = "default"
+
+// Overflow policies
+const (
+	OverflowFail   = "fail"   // steps fail to enqueue (default)
+	OverflowBlock  = "block"  // wait for OverflowTimeout
+	OverflowSpill  = "spill"  // keep new runs in the backlog on disk
+	OverflowReject = "reject" // reject new runs
 )
 
 type RunnerConfig struct {
-	Tags      []string
-	Queues    map[string]interface{}
-	QueueSize int
-	LogDir    string
-	Parallel  int
+	Tags       []string
+	Queues     map[string]int // name -> parallel
+	QueueSize  int            `yaml:"queueSize"`
+	QueueAging time.Duration  `yaml:"queueAging"` // 0: DefaultQueueAging, <0: disabled
+	LogDir     string         `yaml:"logDir"`
+	Parallel   int
+
+	OverflowPolicy  string        `yaml:"overflowPolicy"`
+	OverflowTimeout time.Duration `yaml:"overflowTimeout"` // 0: no limit
+
+	Notify *NotifyConfig // default for the tasks without notify
+
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"` // waiting time for the running tasks on shutdown
+}
+
+func LoadRunnerConfig(path string) (*RunnerConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf RunnerConfig
+	return &conf, yaml.Unmarshal(bytes, &conf)
 }
 
 func (conf *RunnerConfig) FillDefault() *RunnerConfig {
@@ -33,6 +75,16 @@ func (conf *RunnerConfig) FillDefault() *RunnerConfig {
 	if conf.Parallel == 0 {
 		conf.Parallel = 8
 	}
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	if conf.Queues[DefaultQueue] == 0 {
+		conf.Queues = maps.Clone(conf.Queues)
+		if conf.Queues == nil {
+			conf.Queues = map[string]int{}
+		}
+		conf.Queues[DefaultQueue] = conf.Parallel
+	}
 	return conf
 }
 
@@ -41,7 +93,19 @@ type LogEntry struct {
 	RunID  int64      `json:"runId"`
 	Task   *TaskState `json:"task"`
 
+	Priority int   `json:"priority,omitempty"`
+	RerunOf  int64 `json:"rerunOf,omitempty"`
+
 	Params map[string]any `json:"params,omitempty"`
+
+	mutex sync.Mutex // guards Task while running
+}
+
+// Snapshot returns a copy which is safe to read while the run is updated.
+func (log *LogEntry) Snapshot() *LogEntry {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	return &LogEntry{TaskID: log.TaskID, RunID: log.RunID, Task: log.Task.clone(), Priority: log.Priority, RerunOf: log.RerunOf, Params: log.Params}
 }
 
 type TaskState struct {
@@ -55,13 +119,33 @@ type TaskState struct {
 	FinishedAt int64  `json:"finishedAt"`
 	LogFile    string `json:"logFile,omitempty"`
 	Message    string `json:"message,omitempty"`
+	PeakMemory int64  `json:"peakMemory,omitempty"` // bytes
+	CPUTime    int64  `json:"cpuTime,omitempty"`    // ms
+
+	Outputs    map[string]any  `json:"outputs,omitempty"`
+	Attempts   []*AttemptState `json:"attempts,omitempty"`
+	ReusedFrom int64           `json:"reusedFrom,omitempty"` // runId of the run that executed the step
+	Approval   *ApprovalState  `json:"approval,omitempty"`
+}
+
+type AttemptState struct {
+	Attempt    int    `json:"attempt"`
+	Status     string `json:"status"`
+	StartedAt  int64  `json:"startedAt"`
+	FinishedAt int64  `json:"finishedAt"`
+	LogFile    string `json:"logFile,omitempty"`
+	Message    string `json:"message,omitempty"`
 }
 
 func (ts *TaskState) setResult(result *TaskResult) {
 	ts.FinishedAt = time.Now().UnixMilli()
 	ts.Message = result.Message
+	ts.PeakMemory = result.PeakMemory
+	ts.CPUTime = result.CPUTime.Milliseconds()
 
-	if result.Canceled {
+	if result.TimedOut {
+		ts.Status = "timeout"
+	} else if result.Canceled {
 		ts.Status = "canceled"
 	} else if !result.Success {
 		ts.Status = "failed"
@@ -70,11 +154,58 @@ func (ts *TaskState) setResult(result *TaskResult) {
 	}
 }
 
+// clone returns a deep copy of the state. Outputs and Approval are not modified after set.
+func (ts *TaskState) clone() *TaskState {
+	c := *ts
+	c.Steps = nil
+	for _, s := range ts.Steps {
+		c.Steps = append(c.Steps, s.clone())
+	}
+	c.Attempts = slices.Clone(ts.Attempts)
+	return &c
+}
+
+func (ts *TaskState) active() bool {
+	switch ts.Status {
+	case "queued", "running", "retrying", "waiting_approval", "paused":
+		return true
+	}
+	return false
+}
+
+// findByLogFile returns the step which writes the log file.
+func (ts *TaskState) findByLogFile(logFile string) *TaskState {
+	if ts.LogFile == logFile {
+		return ts
+	}
+	for _, s := range ts.Steps {
+		if f := s.findByLogFile(logFile); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (ts *TaskState) addAttempt(attempt int, startedAt int64) {
+	ts.Attempts = append(ts.Attempts, &AttemptState{
+		Attempt:    attempt,
+		Status:     ts.Status,
+		StartedAt:  startedAt,
+		FinishedAt: ts.FinishedAt,
+		LogFile:    ts.LogFile,
+		Message:    ts.Message,
+	})
+}
+
 type runState struct {
-	task   *TaskState
-	config *TaskConfig
-	done   chan struct{}
-	cancel context.CancelFunc
+	task     *TaskState
+	config   *TaskConfig
+	done     chan struct{}
+	finished chan struct{} // closed after finishTask. (root only)
+	ctx      context.Context
+	cancel   context.CancelCauseFunc
+	kill     context.CancelCauseFunc // cancels the steps triggered always too. (root only)
+	inputs   map[string]any          // outputs of the dependencies
 
 	log *LogEntry
 }
@@ -83,23 +214,139 @@ func (t *runState) wait() {
 	<-t.done
 }
 
+// stop cancels the run. The steps triggered always are canceled by the second stop or the shutdown.
+func (t *runState) stop(cause error) {
+	if t.ctx.Err() != nil || errors.Is(cause, ErrShuttingDown) {
+		t.kill(cause)
+	}
+	t.cancel(cause)
+}
+
+type killCtxKey struct{}
+
+// killContext returns the context for the steps triggered always, which is not canceled by the first stop.
+func killContext(ctx context.Context) context.Context {
+	if kill, ok := ctx.Value(killCtxKey{}).(context.Context); ok {
+		return kill
+	}
+	return context.WithoutCancel(ctx)
+}
+
+// lock locks the states of the run. Runner.mutex must not be acquired while locked.
+func (t *runState) lock() {
+	t.log.mutex.Lock()
+}
+
+func (t *runState) unlock() {
+	t.log.mutex.Unlock()
+}
+
 type Runner struct {
 	runnings    []*runState
-	queue       *TaskQueue
+	backlog     []*backlogEntry
+	subscribers []chan *LogEntry
+	approvals   map[*TaskState]chan *ApprovalState
+	pausedRuns  map[*LogEntry]chan struct{}
+	pausedAll   chan struct{}
+	queues      map[string]*TaskQueue
+	stopQueues  context.CancelFunc
+	shutdown    bool
+	wg          sync.WaitGroup // running runs
 	mutex       sync.RWMutex
+	saveMutex   sync.Mutex
 	recentLimit int
 	logDir      string
+	metrics     *Metrics
+
+	notifyConfig    *NotifyConfig
+	notifyCtx       context.Context // canceled when the shutdown deadline passes
+	stopNotify      context.CancelFunc
+	overflowPolicy  string
+	overflowTimeout time.Duration
 }
 
 func NewRunner(conf *RunnerConfig) *Runner {
 	conf = conf.FillDefault()
-	queue := NewTaskQueue(conf.Parallel, conf.QueueSize, false)
-	queue.Start(context.Background())
-	return &Runner{
-		queue:       queue,
+	queues := map[string]*TaskQueue{}
+	ctx, stopQueues := context.WithCancel(context.Background())
+	for name, parallel := range conf.Queues {
+		queues[name] = NewTaskQueue(parallel, conf.QueueSize, false)
+		if conf.QueueAging != 0 {
+			queues[name].SetAging(max(conf.QueueAging, 0))
+		}
+		queues[name].Start(ctx)
+	}
+	notifyCtx, stopNotify := context.WithCancel(context.Background())
+	r := &Runner{
+		queues:      queues,
+		stopQueues:  stopQueues,
+		approvals:   map[*TaskState]chan *ApprovalState{},
+		pausedRuns:  map[*LogEntry]chan struct{}{},
 		logDir:      conf.LogDir,
 		recentLimit: 100,
+		metrics:     NewMetrics(),
+
+		notifyConfig:    conf.Notify,
+		notifyCtx:       notifyCtx,
+		stopNotify:      stopNotify,
+		overflowPolicy:  conf.OverflowPolicy,
+		overflowTimeout: conf.OverflowTimeout,
+	}
+	if r.overflowPolicy == OverflowSpill {
+		r.loadBacklog()
+		go r.drainBacklog(context.Background())
+	}
+	return r
+}
+
+func (r *Runner) Queue(name string) *TaskQueue {
+	return r.queues[name]
+}
+
+func (r *Runner) Queues() []*QueueStats {
+	var stats []*QueueStats
+	r.mutex.RLock()
+	backlog := map[string]int{}
+	for _, b := range r.backlog {
+		backlog[b.queueName()]++
+	}
+	r.mutex.RUnlock()
+	for name, q := range r.queues {
+		st := q.Stats()
+		st.Name = name
+		st.Backlog = backlog[name]
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+func (r *Runner) checkQueues(config *TaskConfig) error {
+	if config.Queue != "" && r.queues[config.Queue] == nil {
+		return fmt.Errorf("unknown queue: %s", config.Queue)
+	}
+	for _, t := range config.Steps {
+		if err := r.checkQueues(t); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// queuesFull reports whether any queue used by the task is full.
+func (r *Runner) queuesFull(config *TaskConfig, queue string) bool {
+	if config.Queue != "" {
+		queue = config.Queue
+	}
+	if len(config.Steps) == 0 {
+		return r.queues[queue] != nil && r.queues[queue].Full()
+	}
+	for _, t := range config.Steps {
+		if r.queuesFull(t, queue) {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Runner) LogDir() string {
@@ -107,26 +354,67 @@ func (r *Runner) LogDir() string {
 }
 
 func (r *Runner) Start(config *TaskConfig, params map[string]any) (*LogEntry, error) {
-	// TODO: validate task graph before start.
-	log := &LogEntry{
-		TaskID: config.TaskID,
-		RunID:  time.Now().UnixMilli(),
-		Task:   NewTaskLog(config),
-		Params: params,
-	}
-	if !config.AllowParallel && r.exists(config.TaskID, params) {
+	return r.start(config, &LogEntry{Task: NewTaskLog(config), Params: params})
+}
+
+// start starts the run of the log which has the initial state and params.
+func (r *Runner) start(config *TaskConfig, log *LogEntry) (*LogEntry, error) {
+	if r.ShuttingDown() {
+		return nil, ErrShuttingDown
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if err := r.checkQueues(config); err != nil {
+		return nil, err
+	}
+	log.TaskID = config.TaskID
+	log.RunID = time.Now().UnixMilli()
+	log.Priority = config.Priority
+	if !config.AllowParallel && r.exists(config.TaskID, log.Params) {
 		return nil, fmt.Errorf("Already running")
 	}
-	state := r.startInternal(context.Background(), config, log, log.Task)
+	if r.queuesFull(config, DefaultQueue) {
+		switch r.overflowPolicy {
+		case OverflowReject:
+			return nil, ErrQueueFull
+		case OverflowSpill:
+			r.addBacklog(config, log)
+			return log.Snapshot(), nil
+		}
+	}
+	r.launch(config, log)
+	return log.Snapshot(), nil
+}
+
+func (r *Runner) Metrics() *Metrics {
+	return r.metrics
+}
+
+func (r *Runner) launch(config *TaskConfig, log *LogEntry) {
+	r.metrics.runStarted(log)
+	kill, cancel := context.WithCancelCause(context.Background())
+	state := r.startInternal(context.WithValue(kill, killCtxKey{}, kill), config, log, log.Task, nil)
+	state.kill = cancel
 	r.addTask(state)
+	r.wg.Add(1)
 	go func() {
+		defer r.wg.Done()
 		state.wait()
-		r.finishTask(state)
+		cancel(nil)
+		notify := r.finishTask(state)
+		close(state.finished)
+		// notify after the run is recorded not to delay the waiters.
+		if notify {
+			r.notify(state.config, state.log)
+		}
 	}()
-	return log, nil
 }
 
 func (r *Runner) Invoke(ctx context.Context, config *TaskConfig, params map[string]any) (*TaskResult, error) {
+	if r.ShuttingDown() {
+		return nil, ErrShuttingDown
+	}
 	result := config.Run(ctx, params, nil)
 
 	if !config.DisableLog {
@@ -143,25 +431,33 @@ func (r *Runner) Invoke(ctx context.Context, config *TaskConfig, params map[stri
 	return result, nil
 }
 
-func (r *Runner) startInternal(ctx context.Context, config *TaskConfig, logEnt *LogEntry, log *TaskState) *runState {
-	ctx2, cancel := context.WithCancel(ctx)
+func (r *Runner) startInternal(ctx context.Context, config *TaskConfig, logEnt *LogEntry, log *TaskState, inputs map[string]any) *runState {
+	ctx2, cancel := context.WithCancelCause(ctx)
 	state := &runState{
-		task:   log,
-		config: config,
-		done:   make(chan struct{}),
-		cancel: cancel,
-		log:    logEnt,
-	}
-	for _, t := range config.Steps {
-		state.task.Steps = append(state.task.Steps, NewTaskLog(t))
+		task:     log,
+		config:   config,
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+		ctx:      ctx2,
+		cancel:   cancel,
+		inputs:   inputs,
+		log:      logEnt,
 	}
 	for k, v := range logEnt.Params {
-		if config.Variables != nil && config.Variables[k] != nil {
+		if _, ok := config.Variables[k]; ok {
 			config.Variables[k] = v
 		}
 	}
 
+	state.lock()
+	if len(state.task.Steps) == 0 {
+		for _, t := range config.Steps {
+			state.task.Steps = append(state.task.Steps, NewTaskLog(t))
+		}
+	}
 	state.task.Status = "queued"
+	state.unlock()
+	r.updated(logEnt)
 	go func() {
 		state.run(ctx2, r)
 	}()
@@ -171,28 +467,122 @@ func (r *Runner) startInternal(ctx context.Context, config *TaskConfig, logEnt *
 func (r *Runner) Stop(taskID string, runID int64) bool {
 	state := r.getRunningTask(taskID, runID)
 	if state == nil {
-		return false
+		return r.cancelBacklog(taskID, runID)
 	}
-	state.cancel()
+	state.stop(nil)
 	return true
 }
 
+// Done returns a channel that's closed when the run finishes and is recorded, or nil if the run is not running.
+func (r *Runner) Done(taskID string, runID int64) <-chan struct{} {
+	state := r.getRunningTask(taskID, runID)
+	if state == nil {
+		return nil
+	}
+	return state.finished
+}
+
+// Subscribe returns a channel to receive the running tasks on each state change.
+func (r *Runner) Subscribe() (<-chan *LogEntry, func()) {
+	ch := make(chan *LogEntry, 16)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.subscribers = append(r.subscribers, ch)
+	return ch, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		for i, c := range r.subscribers {
+			if c == ch {
+				r.subscribers = append(r.subscribers[:i], r.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// StepActive reports whether the step which writes the log file is running.
+func (r *Runner) StepActive(logFile string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, t := range r.runnings {
+		t.lock()
+		s := t.task.findByLogFile(logFile)
+		active := s != nil && s.active()
+		t.unlock()
+		if s != nil {
+			return active
+		}
+	}
+	return false
+}
+
 func (r *Runner) Wait(taskID string, runID int64) bool {
 	state := r.getRunningTask(taskID, runID)
 	if state == nil {
 		return false
 	}
-	state.wait()
+	<-state.finished
 	return true
 }
 
+// GetRun returns the running or recent run.
+func (r *Runner) GetRun(taskID string, runID int64) *LogEntry {
+	for _, ent := range r.GetHistory(taskID, r.recentLimit) {
+		if ent.RunID == runID {
+			return ent
+		}
+	}
+	return nil
+}
+
+// WaitRun blocks until the run is finished or ctx is done, and returns the latest LogEntry.
+func (r *Runner) WaitRun(ctx context.Context, taskID string, runID int64) (*LogEntry, error) {
+	for {
+		if state := r.getRunningTask(taskID, runID); state != nil {
+			select {
+			case <-state.finished:
+				return state.log.Snapshot(), nil
+			case <-ctx.Done():
+				return state.log.Snapshot(), ctx.Err()
+			}
+		}
+		ent := r.GetRun(taskID, runID)
+		if ent == nil {
+			return nil, ErrRunNotFound
+		}
+		if ent.Task.finished() {
+			return ent, nil
+		}
+		// wait for the run in the backlog to start
+		select {
+		case <-ctx.Done():
+			return ent, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// RunAndWait starts the task and blocks until the run is finished or ctx is done.
+func (r *Runner) RunAndWait(ctx context.Context, config *TaskConfig, params map[string]any) (*LogEntry, error) {
+	ent, err := r.Start(config, params)
+	if err != nil {
+		return nil, err
+	}
+	return r.WaitRun(ctx, ent.TaskID, ent.RunID)
+}
+
 func (r *Runner) RunningTaks(taskID string) []*LogEntry {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 	var tasks []*LogEntry
 	for _, t := range r.runnings {
 		if t.log.TaskID == taskID {
-			tasks = append(tasks, t.log)
+			tasks = append(tasks, t.log.Snapshot())
+		}
+	}
+	for _, b := range r.backlog {
+		if b.Log.TaskID == taskID {
+			tasks = append(tasks, b.Log.Snapshot())
 		}
 	}
 	return tasks
@@ -200,6 +590,10 @@ func (r *Runner) RunningTaks(taskID string) []*LogEntry {
 
 func (r *Runner) GetHistory(taskID string, limit int) []*LogEntry {
 	log := r.RunningTaks(taskID)
+	running := map[int64]bool{}
+	for _, ent := range log {
+		running[ent.RunID] = true
+	}
 
 	f, err := os.Open(filepath.Join(r.logDir, taskID, "task.log"))
 	if err != nil {
@@ -215,7 +609,7 @@ func (r *Runner) GetHistory(taskID string, limit int) []*LogEntry {
 	for scanner.Scan() {
 		line := scanner.Bytes()
 		var ent LogEntry
-		if json.Unmarshal(line, &ent) == nil && ent.Task != nil {
+		if json.Unmarshal(line, &ent) == nil && ent.Task != nil && !running[ent.RunID] {
 			log2 = append(log2, &ent)
 		}
 	}
@@ -228,50 +622,154 @@ func (r *Runner) GetHistory(taskID string, limit int) []*LogEntry {
 	return log
 }
 
+func hasPending(steps map[string]*TaskState) bool {
+	for _, s := range steps {
+		if s.Status == "" {
+			return true
+		}
+	}
+	return false
+}
+
 func (state *runState) tryStartSteps(r *Runner, ctx context.Context, steps map[string]*TaskState, done chan struct{}) int {
+	if ctx.Err() == nil && r.pauseCh(state.log) != nil {
+		return 0
+	}
 	startCount := 0
-	for _, child := range state.config.Steps {
-		clog := steps[child.Name]
-		if clog.Status != "" {
-			// already started
-			continue
-		}
-		ready := true
-		for _, d := range child.Depends {
-			dt := steps[d]
-			if dt == nil || dt.Status != "success" {
-				ready = false
+	for changed := true; changed; {
+		changed = false
+		for _, child := range state.config.Steps {
+			clog := steps[child.Name]
+			state.lock()
+			if clog.Status != "" {
+				// already started
+				state.unlock()
+				continue
+			}
+			var deps []*TaskState
+			for _, d := range child.Depends {
+				deps = append(deps, steps[d])
+			}
+			run, status := triggered(child.Trigger, deps)
+			inputs := map[string]any{}
+			for k, v := range state.inputs {
+				inputs[k] = v
+			}
+			for _, d := range deps {
+				for k, v := range d.Outputs {
+					inputs[k] = v
+				}
+			}
+			state.unlock()
+			if !run && status == "" {
+				continue
 			}
-		}
-		if !ready {
-			continue
-		}
 
-		if child.Dir == "" {
-			child.Dir = state.config.Dir
-		}
+			ctx := ctx
+			if ctx.Err() != nil {
+				if child.Trigger == TriggerAlways {
+					// keeps running until the second stop, but the timeout of the step is applied.
+					ctx = killContext(ctx)
+				} else if run {
+					run, status = false, ctxStatus(ctx)
+				}
+			}
+			var message string
+			if run && child.When != "" {
+				// the run params override the defaults of the step as in startInternal.
+				ok, err := EvalCondition(child.When, mergeParams(mergeParams(child.Variables, state.log.Params), inputs))
+				if err != nil {
+					run, status, message = false, "failed", err.Error()
+				} else if !ok {
+					run, status = false, "skipped"
+				}
+			}
+			if !run {
+				state.lock()
+				clog.Status = status
+				clog.FinishedAt = time.Now().UnixMilli()
+				if message != "" {
+					clog.Message = message
+				}
+				state.unlock()
+				r.updated(state.log)
+				changed = true
+				continue
+			}
 
-		cs := r.startInternal(ctx, child, state.log, clog)
-		startCount++
-		go func() {
-			cs.wait()
-			done <- struct{}{}
-		}()
+			if child.Dir == "" {
+				child.Dir = state.config.Dir
+			}
+			if child.Queue == "" {
+				child.Queue = state.config.Queue
+			}
+			if child.Priority == 0 {
+				child.Priority = state.config.Priority
+			}
+
+			cs := r.startInternal(ctx, child, state.log, clog, inputs)
+			startCount++
+			go func() {
+				cs.wait()
+				done <- struct{}{}
+			}()
+		}
 	}
 	return startCount
 }
 
+// ctxStatus returns the status for a run whose context is done.
+func ctxStatus(ctx context.Context) string {
+	if errors.Is(context.Cause(ctx), ErrTaskTimeout) {
+		return "timeout"
+	} else if errors.Is(context.Cause(ctx), ErrShuttingDown) {
+		return "interrupted"
+	}
+	return "canceled"
+}
+
 func (state *runState) run(ctx context.Context, r *Runner) {
 	defer close(state.done)
+	defer r.updated(state.log)
+
+	if state.config.Approval {
+		if !state.waitApproval(ctx, r) {
+			return
+		}
+		if len(state.config.Steps) == 0 && state.config.Command == "" && state.config.Runtime == "" {
+			// approval only
+			state.finish("success", "")
+			return
+		}
+	}
+
+	if len(state.config.Steps) > 0 && state.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, state.config.Timeout, ErrTaskTimeout)
+		defer cancel()
+	}
 
 	steps := map[string]*TaskState{}
+	state.lock()
 	for _, t := range state.task.Steps {
 		steps[t.Name] = t
 	}
+	state.unlock()
 
+	root := state.task == state.log.Task
 	if len(steps) > 0 {
-		state.task.StartedAt = time.Now().UnixMilli()
-		state.task.Status = "running"
+		state.setStatus("running", true)
+		r.updated(state.log)
+		if root {
+			r.refreshPaused(state)
+		}
+	} else if root && r.pauseCh(state.log) != nil {
+		state.setStatus("paused", false)
+		r.updated(state.log)
+		if !r.waitResumed(ctx, state.log) {
+			state.finish(ctxStatus(ctx), "")
+			return
+		}
 	}
 
 	runnings := 0
@@ -279,47 +777,150 @@ func (state *runState) run(ctx context.Context, r *Runner) {
 	for {
 		runnings += state.tryStartSteps(r, ctx, steps, stepDone)
 		if runnings == 0 {
-			break
+			state.lock()
+			pending := hasPending(steps)
+			state.unlock()
+			if !pending || ctx.Err() != nil || r.pauseCh(state.log) == nil {
+				break
+			}
+			// paused
+			r.waitResumed(ctx, state.log)
+			continue
 		}
 		<-stepDone
 		runnings--
 	}
 	select {
 	case <-ctx.Done():
-		state.task.FinishedAt = time.Now().UnixMilli()
-		state.task.Status = "canceled"
+		state.finish(ctxStatus(ctx), "")
 		return
 	default:
 	}
 	ok := true
+	state.lock()
 	for _, d := range state.task.Steps {
-		if d.Status != "success" {
+		if !d.succeeded() {
 			ok = false
 		}
 	}
+	state.unlock()
 	if !ok {
-		state.task.FinishedAt = time.Now().UnixMilli()
-		state.task.Status = "failed"
-		state.task.Message = "sub tasks are not completed"
+		state.finish("failed", "sub tasks are not completed")
 		return
 	}
 
-	tid := state.log.TaskID + ":" + state.task.Name + fmt.Sprintf(".%d", time.Now().UnixMilli())
-	queueState, _ := r.queue.TryPostFunc(func() {
-		if state.task.StartedAt == 0 {
-			state.task.StartedAt = time.Now().UnixMilli()
-			state.task.Status = "running"
+	for attempt := 1; ; attempt++ {
+		result := state.runAttempt(ctx, r, attempt)
+		retry := state.config.Retry
+		if !retry.ShouldRetry(attempt, result) {
+			return
 		}
+		state.setStatus("retrying", false)
+		r.updated(state.log)
+		select {
+		case <-ctx.Done():
+			state.setStatus(ctxStatus(ctx), false)
+			return
+		case <-time.After(retry.Delay(attempt)):
+		}
+	}
+}
+
+// setStatus sets the status of the step. start sets StartedAt too.
+func (state *runState) setStatus(status string, start bool) {
+	state.lock()
+	defer state.unlock()
+	if start {
+		state.task.StartedAt = time.Now().UnixMilli()
+	}
+	state.task.Status = status
+}
+
+// finish sets the final status of the step. message is set if not empty.
+func (state *runState) finish(status, message string) {
+	state.lock()
+	defer state.unlock()
+	state.task.FinishedAt = time.Now().UnixMilli()
+	state.task.Status = status
+	if message != "" {
+		state.task.Message = message
+	}
+}
+
+func (state *runState) params() map[string]any {
+	return mergeParams(state.config.Variables, state.inputs)
+}
+
+func mergeParams(vars map[string]any, inputs map[string]any) map[string]any {
+	if len(inputs) == 0 {
+		return vars
+	}
+	params := map[string]any{}
+	for k, v := range vars {
+		params[k] = v
+	}
+	for k, v := range inputs {
+		params[k] = v
+	}
+	return params
+}
+
+// normalizeNumbers converts json.Number in the params decoded with UseNumber into int64 or float64.
+// Integers out of the range of int64 are kept as json.Number to avoid losing the digits.
+func normalizeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		} else if !strings.ContainsAny(v.String(), ".eE") {
+			return v
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, e := range v {
+			v[k] = normalizeNumbers(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = normalizeNumbers(e)
+		}
+	}
+	return v
+}
+
+func (state *runState) runAttempt(ctx context.Context, r *Runner, attempt int) *TaskResult {
+	var result *TaskResult
+	tid := fmt.Sprintf("%s:%d:%s.%d", state.log.TaskID, state.log.RunID, state.task.Name, attempt)
+	queue := r.queues[state.config.Queue]
+	if queue == nil {
+		queue = r.queues[DefaultQueue]
+	}
+	queueState, _ := r.post(ctx, queue, taskFunc(func() {
 		if state.config.Command == "" {
-			state.task.FinishedAt = time.Now().UnixMilli()
-			state.task.Status = "success"
+			state.finish("success", "")
 			return
 		}
 
-		var logWriter io.Writer
+		startedAt := time.Now().UnixMilli()
+		var logFile string
 		if !state.config.DisableLog {
-			state.task.LogFile = fmt.Sprintf("%s/%d_%s.log", state.log.TaskID, state.log.RunID, state.task.Name)
-			logPath := filepath.Join(r.logDir, state.task.LogFile)
+			logFile = fmt.Sprintf("%s/%d_%s.log", state.log.TaskID, state.log.RunID, state.task.Name)
+			if attempt > 1 {
+				logFile = fmt.Sprintf("%s/%d_%s.%d.log", state.log.TaskID, state.log.RunID, state.task.Name, attempt)
+			}
+		}
+		state.lock()
+		if state.task.StartedAt == 0 {
+			state.task.StartedAt = startedAt
+		}
+		state.task.Status = "running"
+		state.task.LogFile = logFile
+		state.unlock()
+
+		var logWriter io.Writer
+		if logFile != "" {
+			logPath := filepath.Join(r.logDir, logFile)
 			_ = os.MkdirAll(filepath.Dir(logPath), os.ModePerm)
 			log, _ := os.Create(logPath)
 			if log != nil {
@@ -327,23 +928,79 @@ func (state *runState) run(ctx context.Context, r *Runner) {
 			}
 			logWriter = log
 		}
+		r.updated(state.log)
 
-		result := state.config.Run(ctx, state.config.Variables, logWriter)
-		if !result.Success {
-			select {
-			case <-ctx.Done():
+		runCtx := ctx
+		if state.config.Timeout > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeoutCause(ctx, state.config.Timeout, ErrTaskTimeout)
+			defer cancel()
+		}
+		result = state.config.Run(runCtx, state.params(), logWriter)
+		if !result.Success && runCtx.Err() != nil {
+			if ctxStatus(runCtx) == "timeout" {
+				result.TimedOut = true
+				result.Message = "timed out"
+				if result.Signal != "" {
+					result.Message += ", stopped by " + result.Signal
+				}
+			} else {
 				result.Canceled = true
-			default:
 			}
 		}
+		state.lock()
+		defer state.unlock()
 		state.task.setResult(result)
-	}, tid)
+		if result.Canceled && ctxStatus(runCtx) == "interrupted" {
+			state.task.Status = "interrupted"
+			state.task.Message = "server stopped while running"
+			if result.Signal != "" {
+				state.task.Message += ", stopped by " + result.Signal
+			}
+		}
+		if result.Success {
+			state.task.Outputs = result.Result
+		}
+		if state.config.Retry != nil {
+			state.task.addAttempt(attempt, startedAt)
+		}
+	}), tid, state.config.Priority)
 	if queueState == nil {
-		state.task.Status = "failed"
-		state.task.Message = "failed to enqueue"
-		return
+		if ctx.Err() != nil {
+			state.finish(ctxStatus(ctx), "")
+		} else {
+			state.finish("failed", "failed to enqueue")
+		}
+		return nil
+	}
+	select {
+	case <-queueState.Done():
+	case <-ctx.Done():
+		// don't occupy the queue until dequeued.
+		queue.Cancel(tid)
+		<-queueState.Done()
+	}
+	if queueState.Canceled() {
+		if ctx.Err() != nil {
+			state.finish(ctxStatus(ctx), "")
+		} else {
+			state.finish("canceled", "removed from queue")
+		}
+	}
+	return result
+}
+
+// post enqueues the task according to the overflow policy.
+func (r *Runner) post(ctx context.Context, queue *TaskQueue, task Task, id string, priority int) (*QueueEntry, bool) {
+	if r.overflowPolicy != OverflowBlock && r.overflowPolicy != OverflowSpill {
+		return queue.TryPostWithPriority(task, id, priority)
+	}
+	if r.overflowTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.overflowTimeout)
+		defer cancel()
 	}
-	<-queueState.Done()
+	return queue.PostWithContext(ctx, task, id, priority)
 }
 
 func NewTaskLog(task *TaskConfig) *TaskState {
@@ -353,23 +1010,148 @@ func NewTaskLog(task *TaskConfig) *TaskState {
 	}
 }
 
-func mapEqual[K, V comparable](a map[K]V, b map[K]V) bool {
-	if len(a) != len(b) {
-		return false
+// reusable reports whether the step can be reused in a new run.
+func (ts *TaskState) reusable() bool {
+	return ts != nil && (ts.Status == "success" || ts.ReusedFrom != 0)
+}
+
+// reusedTaskLog returns a copy of the step marked as skipped.
+func reusedTaskLog(prev *TaskState, prevRunID int64) *TaskState {
+	ts := *prev
+	if ts.ReusedFrom == 0 {
+		ts.ReusedFrom = prevRunID
 	}
-	for k, va := range a {
-		if vb, ok := b[k]; !ok || vb != va {
-			return false
+	ts.Status = "skipped"
+	ts.Message = fmt.Sprintf("reused from run %d", ts.ReusedFrom)
+	return &ts
+}
+
+func findTaskLog(steps []*TaskState, name string) *TaskState {
+	for _, s := range steps {
+		if s.Name == name {
+			return s
 		}
 	}
-	return true
+	return nil
+}
+
+// reuseTaskLog returns a new state in which the steps succeeded in prev are already completed unless their dependencies are run again.
+func reuseTaskLog(task *TaskConfig, prev *TaskState, prevRunID int64) *TaskState {
+	ts := NewTaskLog(task)
+	if prev == nil {
+		return ts
+	}
+	// the dependents of the steps to run are also run again.
+	reuse := map[string]bool{}
+	for _, t := range task.Steps {
+		reuse[t.Name] = findTaskLog(prev.Steps, t.Name).reusable()
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, t := range task.Steps {
+			for _, d := range t.Depends {
+				if reuse[t.Name] && !reuse[d] {
+					reuse[t.Name] = false
+					changed = true
+				}
+			}
+		}
+	}
+	for _, t := range task.Steps {
+		p := findTaskLog(prev.Steps, t.Name)
+		if reuse[t.Name] {
+			ts.Steps = append(ts.Steps, reusedTaskLog(p, prevRunID))
+		} else {
+			ts.Steps = append(ts.Steps, reuseTaskLog(t, p, prevRunID))
+		}
+	}
+	return ts
+}
+
+// rerunStepLog returns a new state in which only the step specified by the path is not completed.
+// The other steps not succeeded in prev keep their status.
+func rerunStepLog(task *TaskConfig, prev *TaskState, prevRunID int64, path []string) (*TaskState, error) {
+	ts := NewTaskLog(task)
+	found := false
+	for _, t := range task.Steps {
+		p := findTaskLog(prev.Steps, t.Name)
+		if t.Name == path[0] {
+			found = true
+			if len(path) == 1 {
+				ts.Steps = append(ts.Steps, NewTaskLog(t))
+			} else if p == nil {
+				return nil, fmt.Errorf("%w: %s", ErrStepNotFound, strings.Join(path, "."))
+			} else {
+				s, err := rerunStepLog(t, p, prevRunID, path[1:])
+				if err != nil {
+					return nil, err
+				}
+				ts.Steps = append(ts.Steps, s)
+			}
+		} else if p.reusable() {
+			ts.Steps = append(ts.Steps, reusedTaskLog(p, prevRunID))
+		} else {
+			s := NewTaskLog(t)
+			s.Status = "skipped"
+			s.Message = "not selected"
+			if p != nil && p.Status != "" && !p.succeeded() {
+				// carry the failure forward not to report the partial rerun as succeeded.
+				s.Status = p.Status
+				s.Message = fmt.Sprintf("not selected, %s in run %d", p.Status, prevRunID)
+			}
+			ts.Steps = append(ts.Steps, s)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrStepNotFound, strings.Join(path, "."))
+	}
+	return ts, nil
+}
+
+// Rerun starts a new run with the params of the previous run, reusing the succeeded steps.
+// If step is not empty, only the step (e.g. "build" or "deploy.upload") is run.
+func (r *Runner) Rerun(config *TaskConfig, runID int64, step string) (*LogEntry, error) {
+	prev := r.GetRun(config.TaskID, runID)
+	if prev == nil {
+		return nil, ErrRunNotFound
+	}
+	if !prev.Task.finished() {
+		return nil, fmt.Errorf("run %d is not finished", runID)
+	}
+	task := reuseTaskLog(config, prev.Task, runID)
+	if step != "" {
+		var err error
+		if task, err = rerunStepLog(config, prev.Task, runID, strings.Split(step, ".")); err != nil {
+			return nil, err
+		}
+	}
+	return r.start(config, &LogEntry{Task: task, Params: prev.Params, RerunOf: runID})
+}
+
+// paramsEqual compares the params by their JSON encodings since the values can be objects or arrays,
+// and the numbers can be int64 or float64 depending on where they are decoded.
+func paramsEqual(a, b map[string]any) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ja, err1 := json.Marshal(a)
+	jb, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && bytes.Equal(ja, jb)
 }
 
 func (r *Runner) exists(taskID string, params map[string]any) bool {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	for _, t := range r.runnings {
-		if t.log.TaskID == taskID && mapEqual(t.log.Params, params) {
+		t.lock()
+		finished := t.task.finished()
+		t.unlock()
+		if t.log.TaskID == taskID && !finished && paramsEqual(t.log.Params, params) {
+			return true
+		}
+	}
+	for _, b := range r.backlog {
+		if b.Log.TaskID == taskID && paramsEqual(b.Log.Params, params) {
 			return true
 		}
 	}
@@ -380,6 +1162,11 @@ func (r *Runner) addTask(state *runState) {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 	r.runnings = append(r.runnings, state)
+	// the run from the backlog is moved at once not to be missing in GetRun.
+	if i := slices.IndexFunc(r.backlog, func(b *backlogEntry) bool { return b.Log == state.log }); i >= 0 {
+		r.backlog = slices.Delete(r.backlog, i, i+1)
+		r.saveBacklog()
+	}
 }
 
 func (r *Runner) appendLog(log *LogEntry) {
@@ -387,6 +1174,7 @@ func (r *Runner) appendLog(log *LogEntry) {
 	if err != nil {
 		return
 	}
+	_ = os.MkdirAll(filepath.Join(r.logDir, log.TaskID), os.ModePerm)
 	f, err := os.OpenFile(filepath.Join(r.logDir, log.TaskID, "task.log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
 	if err != nil {
 		return
@@ -407,18 +1195,124 @@ func (r *Runner) getRunningTask(taskID string, runID int64) *runState {
 	return nil
 }
 
-func (r *Runner) finishTask(state *runState) {
-	go func() {
-		state.wait()
+func (r *Runner) runStatePath(log *LogEntry) string {
+	return filepath.Join(r.logDir, log.TaskID, fmt.Sprintf("%d.run.json", log.RunID))
+}
+
+// updated is called when the state of a run is changed.
+func (r *Runner) updated(log *LogEntry) {
+	snapshot := r.saveRunState(log)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, ch := range r.subscribers {
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+}
+
+// saveRunState persists the state of a running task to recover it after restart, and returns the saved snapshot.
+func (r *Runner) saveRunState(log *LogEntry) *LogEntry {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+	// take the snapshot in saveMutex not to overwrite with an older one.
+	snapshot := log.Snapshot()
+	json, err := json.Marshal(snapshot)
+	if err != nil {
+		return snapshot
+	}
+	path := r.runStatePath(log)
+	_ = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if os.WriteFile(path+".tmp", json, 0600) == nil {
+		os.Rename(path+".tmp", path)
+	}
+	return snapshot
+}
+
+func (r *Runner) removeRunState(log *LogEntry) {
+	r.saveMutex.Lock()
+	defer r.saveMutex.Unlock()
+	os.Remove(r.runStatePath(log))
+}
+
+func markInterrupted(ts *TaskState, now int64) {
+	if ts.active() {
+		ts.Status = "interrupted"
+		ts.FinishedAt = now
+	}
+	for _, s := range ts.Steps {
+		markInterrupted(s, now)
+	}
+}
+
+// Recover marks the runs left by the previous process as interrupted and restarts them according to TaskConfig.OnInterrupted.
+func (r *Runner) Recover(m *Manager) error {
+	files, err := filepath.Glob(filepath.Join(r.logDir, "*", "*.run.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range files {
+		bytes, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var ent LogEntry
+		if json.Unmarshal(bytes, &ent) != nil || ent.Task == nil || r.getRunningTask(ent.TaskID, ent.RunID) != nil {
+			continue
+		}
+		markInterrupted(ent.Task, time.Now().UnixMilli())
+		if ent.Task.Status != "interrupted" {
+			// finished but not logged.
+			r.appendLog(&ent)
+			os.Remove(path)
+			continue
+		}
+		ent.Task.Message = "server stopped while running"
+		r.appendLog(&ent)
+		os.Remove(path)
+
+		config, err := m.Load(ent.TaskID)
+		if err != nil {
+			continue
+		}
+		switch config.OnInterrupted {
+		case "restart":
+			_, err = r.Start(config, ent.Params)
+		case "resume":
+			_, err = r.start(config, &LogEntry{Task: reuseTaskLog(config, ent.Task, ent.RunID), Params: ent.Params})
+		}
+		if err != nil {
+			log.Println("failed to recover", ent.TaskID, err)
+		}
+	}
+	return nil
+}
+
+// finishTask records the finished run, and reports whether it should be notified.
+func (r *Runner) finishTask(state *runState) bool {
+	interrupted := state.log.Task.Status == "interrupted" && r.ShuttingDown()
+	if interrupted {
+		// keep the state for Recover to restart it according to TaskConfig.OnInterrupted.
+		r.saveRunState(state.log)
+	} else {
+		// append the log before removing from runnings not to lose the run in GetHistory.
 		r.appendLog(state.log)
-	}()
+		r.removeRunState(state.log)
+	}
 
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
 	for i, t := range r.runnings {
 		if t == state {
 			r.runnings = append(r.runnings[:i], r.runnings[i+1:]...)
 			break
 		}
 	}
+	delete(r.pausedRuns, state.log)
+	r.mutex.Unlock()
+
+	r.metrics.runFinished(state.log)
+	// not notified since it is not finished yet. (and not to delay the shutdown)
+	return !interrupted
 }
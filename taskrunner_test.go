@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitRunState polls the run until cond is satisfied, and returns the latest snapshot.
+func waitRunState(r *Runner, taskID string, runID int64, cond func(ent *LogEntry) bool) *LogEntry {
+	for i := 0; ; i++ {
+		ent := r.GetRun(taskID, runID)
+		if ent != nil && cond(ent) || i >= 200 {
+			return ent
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunner_RunAndWait(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	conf := &TaskConfig{TaskID: "wait", Steps: []*TaskConfig{
+		{Name: "a", Command: "true"},
+		{Name: "b", Command: "exit 1", Depends: []string{"a"}},
+	}}
+	ent, err := r.RunAndWait(context.Background(), conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.Task.Status != "failed" || ent.Task.Steps[0].Status != "success" || ent.Task.Steps[1].Status != "failed" {
+		t.Errorf("unexpected status: %s %s %s", ent.Task.Status, ent.Task.Steps[0].Status, ent.Task.Steps[1].Status)
+	}
+	if ent2, err := r.WaitRun(context.Background(), "wait", ent.RunID); err != nil || ent2.Task.Status != "failed" {
+		t.Errorf("finished run: %v %v", ent2, err)
+	}
+
+	ent, _ = r.Start(&TaskConfig{TaskID: "sleep", Command: "sleep 10"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	ent, err = r.WaitRun(ctx, "sleep", ent.RunID)
+	if !errors.Is(err, context.DeadlineExceeded) || !ent.Task.active() {
+		t.Errorf("should be timeout: %v %s", err, ent.Task.Status)
+	}
+	r.Stop("sleep", ent.RunID)
+	r.WaitRun(context.Background(), "sleep", ent.RunID)
+
+	if _, err := r.WaitRun(context.Background(), "wait", 1); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("should be not found: %v", err)
+	}
+}
+
+func TestRunner_Rerun(t *testing.T) {
+	dir := t.TempDir()
+	r := NewRunner(&RunnerConfig{LogDir: dir})
+	newConf := func(bCommand string) *TaskConfig {
+		return &TaskConfig{TaskID: "rerun", Steps: []*TaskConfig{
+			{Name: "a", Command: "echo A=1 >> $GOTASK_OUTPUT"},
+			{Name: "b", Command: bCommand, Depends: []string{"a"}},
+			{Name: "c", Command: "true", Depends: []string{"b"}},
+		}}
+	}
+	ent, _ := r.RunAndWait(context.Background(), newConf("exit 1"), nil)
+	if ent.Task.Status != "failed" || ent.Task.Steps[2].Status != "upstream_failed" {
+		t.Fatalf("unexpected status: %s %s", ent.Task.Status, ent.Task.Steps[2].Status)
+	}
+
+	ent2, err := r.Rerun(newConf(`test "$A" = 1`), ent.RunID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent2, _ = r.WaitRun(context.Background(), "rerun", ent2.RunID)
+	a := ent2.Task.Steps[0]
+	if ent2.Task.Status != "success" || a.Status != "skipped" || a.ReusedFrom != ent.RunID || ent2.RerunOf != ent.RunID {
+		t.Errorf("unexpected rerun: %s %s %d", ent2.Task.Status, a.Status, a.ReusedFrom)
+	}
+	if ent2.Task.Steps[1].Status != "success" || ent2.Task.Steps[2].Status != "success" {
+		t.Errorf("failed steps should be run: %s %s", ent2.Task.Steps[1].Status, ent2.Task.Steps[2].Status)
+	}
+
+	ent3, err := r.Rerun(newConf("true"), ent.RunID, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent3, _ = r.WaitRun(context.Background(), "rerun", ent3.RunID)
+	if ent3.Task.Steps[1].Status != "success" || ent3.Task.Steps[2].Status != "upstream_failed" {
+		t.Errorf("only the step should be run: %s %s", ent3.Task.Steps[1].Status, ent3.Task.Steps[2].Status)
+	}
+	if ent3.Task.Status != "failed" {
+		t.Errorf("the steps not selected are still failed: %s", ent3.Task.Status)
+	}
+	if _, err := r.Rerun(newConf("true"), ent.RunID, "x"); !errors.Is(err, ErrStepNotFound) {
+		t.Errorf("should be step not found: %v", err)
+	}
+}
+
+func TestRunner_RerunDependents(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	newConf := func(buildCommand string) *TaskConfig {
+		return &TaskConfig{TaskID: "rerun", Steps: []*TaskConfig{
+			{Name: "cleanup", Command: "true", Depends: []string{"build"}, Trigger: TriggerAlways},
+			{Name: "build", Command: buildCommand},
+		}}
+	}
+	ent, _ := r.RunAndWait(context.Background(), newConf("exit 1"), nil)
+	if ent.Task.Steps[0].Status != "success" || ent.Task.Steps[1].Status != "failed" {
+		t.Fatalf("unexpected status: %s %s", ent.Task.Steps[0].Status, ent.Task.Steps[1].Status)
+	}
+	ent2, err := r.Rerun(newConf("true"), ent.RunID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent2, _ = r.WaitRun(context.Background(), "rerun", ent2.RunID)
+	if cleanup := ent2.Task.Steps[0]; cleanup.Status != "success" || cleanup.ReusedFrom != 0 {
+		t.Errorf("the dependent of the failed step should be run again: %s %d", cleanup.Status, cleanup.ReusedFrom)
+	}
+}
+
+func TestRunner_StopAlways(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	conf := func() *TaskConfig {
+		return &TaskConfig{TaskID: "stop", Steps: []*TaskConfig{
+			{Name: "build", Command: "sleep 10"},
+			{Name: "cleanup", Command: "sleep 10", Depends: []string{"build"}, Trigger: TriggerAlways},
+		}}
+	}
+	stopOnce := func(ent *LogEntry) {
+		waitRunState(r, "stop", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Steps[0].Status == "running" })
+		r.Stop("stop", ent.RunID)
+		waitRunState(r, "stop", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Steps[1].Status == "running" })
+	}
+
+	// the second stop cancels the cleanup.
+	ent, _ := r.Start(conf(), nil)
+	stopOnce(ent)
+	r.Stop("stop", ent.RunID)
+	ent, _ = r.WaitRun(context.Background(), "stop", ent.RunID)
+	if ent.Task.Steps[0].Status != "canceled" || ent.Task.Steps[1].Status != "canceled" {
+		t.Errorf("unexpected status: %s %s", ent.Task.Steps[0].Status, ent.Task.Steps[1].Status)
+	}
+
+	// the shutdown cancels the cleanup.
+	ent, _ = r.Start(conf(), nil)
+	stopOnce(ent)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r.Shutdown(ctx)
+	if ent := r.GetRun("stop", ent.RunID); ent.Task.Steps[1].Status != "interrupted" || time.Since(start) > 5*time.Second {
+		t.Errorf("the cleanup should be interrupted: %s %v", ent.Task.Steps[1].Status, time.Since(start))
+	}
+}
+
+func TestRunner_Approve(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	conf := func() *TaskConfig {
+		return &TaskConfig{TaskID: "approve", AllowParallel: true, Steps: []*TaskConfig{
+			{Name: "build", Command: "true"},
+			{Name: "gate", Approval: true, ApprovalTimeout: time.Second, Depends: []string{"build"}},
+			{Name: "deploy", Command: "true", Depends: []string{"gate"}},
+		}}
+	}
+	waitGate := func(ent *LogEntry) {
+		waitRunState(r, "approve", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Steps[1].Status == "waiting_approval" })
+	}
+
+	ent, _ := r.Start(conf(), nil)
+	waitGate(ent)
+	if err := r.Approve("approve", ent.RunID, "deploy", &ApprovalState{Approved: true}); !errors.Is(err, ErrNotWaitingApproval) {
+		t.Errorf("deploy is not waiting: %v", err)
+	}
+	if err := r.Approve("approve", ent.RunID, "gate", &ApprovalState{Approved: true, By: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	ent, _ = r.WaitRun(context.Background(), "approve", ent.RunID)
+	gate := ent.Task.Steps[1]
+	if ent.Task.Status != "success" || gate.Approval == nil || gate.Approval.By != "alice" || gate.Approval.At == 0 {
+		t.Errorf("unexpected state: %s %v", ent.Task.Status, gate.Approval)
+	}
+
+	ent, _ = r.Start(conf(), nil)
+	waitGate(ent)
+	r.Approve("approve", ent.RunID, "gate", &ApprovalState{Approved: false, By: "bob"})
+	ent, _ = r.WaitRun(context.Background(), "approve", ent.RunID)
+	if ent.Task.Steps[1].Status != "rejected" || ent.Task.Steps[2].Status != "upstream_failed" {
+		t.Errorf("should be rejected: %s %s", ent.Task.Steps[1].Status, ent.Task.Steps[2].Status)
+	}
+
+	// auto reject
+	ent, _ = r.RunAndWait(context.Background(), conf(), nil)
+	if ent.Task.Steps[1].Status != "rejected" || ent.Task.Steps[1].Message != "approval timed out" {
+		t.Errorf("should be timed out: %s %s", ent.Task.Steps[1].Status, ent.Task.Steps[1].Message)
+	}
+}
+
+func TestRunner_Pause(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	ent, _ := r.Start(&TaskConfig{TaskID: "pause", Steps: []*TaskConfig{
+		{Name: "a", Command: "sleep 0.2"},
+		{Name: "b", Command: "true", Depends: []string{"a"}},
+	}}, nil)
+	waitRunState(r, "pause", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Steps[0].Status == "running" })
+	if err := r.Pause("pause", ent.RunID); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	ent = r.GetRun("pause", ent.RunID)
+	if ent.Task.Status != "paused" || ent.Task.Steps[0].Status != "success" || ent.Task.Steps[1].Status != "" {
+		t.Errorf("should be paused: %s %s %s", ent.Task.Status, ent.Task.Steps[0].Status, ent.Task.Steps[1].Status)
+	}
+	if err := r.Resume("pause", ent.RunID); err != nil {
+		t.Fatal(err)
+	}
+	ent, _ = r.WaitRun(context.Background(), "pause", ent.RunID)
+	if ent.Task.Status != "success" {
+		t.Errorf("should be resumed: %s", ent.Task.Status)
+	}
+
+	single, _ := r.Start(&TaskConfig{TaskID: "single", Command: "sleep 0.3"}, nil)
+	waitRunState(r, "single", single.RunID, func(ent *LogEntry) bool { return ent.Task.Status == "running" })
+	if err := r.Pause("single", single.RunID); !errors.Is(err, ErrNotPausable) {
+		t.Errorf("run without steps should not be paused: %v", err)
+	}
+
+	r.PauseAll()
+	if single = r.GetRun("single", single.RunID); single.Task.Status != "running" {
+		t.Errorf("running command should not be paused: %s", single.Task.Status)
+	}
+	ent, _ = r.Start(&TaskConfig{TaskID: "pause2", Command: "true"}, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if ent, err := r.WaitRun(ctx, "pause2", ent.RunID); err == nil || ent.Task.Status != "paused" {
+		t.Errorf("should be paused: %v %s", err, ent.Task.Status)
+	}
+	r.ResumeAll()
+	if ent, _ = r.WaitRun(context.Background(), "pause2", ent.RunID); ent.Task.Status != "success" {
+		t.Errorf("should be resumed: %s", ent.Task.Status)
+	}
+	r.WaitRun(context.Background(), "single", single.RunID)
+}
+
+func TestRunner_Shutdown(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "notified")
+	r := NewRunner(&RunnerConfig{LogDir: dir, Notify: &NotifyConfig{Command: "touch " + marker}})
+	ent, _ := r.Start(&TaskConfig{TaskID: "shutdown", Command: "sleep 10"}, nil)
+	waitRunState(r, "shutdown", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Status == "running" })
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	r.Shutdown(ctx)
+	if time.Since(start) > DefaultStopGracePeriod {
+		t.Errorf("command should be terminated: %v", time.Since(start))
+	}
+	// the state is kept for Recover instead of the history.
+	var saved LogEntry
+	b, err := os.ReadFile(r.runStatePath(ent))
+	if err != nil || json.Unmarshal(b, &saved) != nil || saved.Task.Status != "interrupted" {
+		t.Errorf("should be interrupted: %v %s", err, b)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("interrupted run should not be notified")
+	}
+	if _, err := r.Start(&TaskConfig{TaskID: "shutdown2", Command: "true"}, nil); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("should be refused: %v", err)
+	}
+}
+
+func TestRunner_StartBacklog(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir(), Parallel: 1, QueueSize: 1, OverflowPolicy: OverflowSpill})
+	for i := 1; i <= 3; i++ {
+		r.addBacklog(&TaskConfig{TaskID: "backlog", Command: "sleep 0.1"}, &LogEntry{TaskID: "backlog", RunID: int64(i), Task: &TaskState{}})
+	}
+	r.startBacklog()
+	r.mutex.RLock()
+	rest := len(r.backlog)
+	r.mutex.RUnlock()
+	if rest != 2 {
+		t.Errorf("only one run should be started: %d", rest)
+	}
+	for i := 0; i < 100; i++ {
+		r.mutex.RLock()
+		done := len(r.backlog) == 0 && len(r.runnings) == 0
+		r.mutex.RUnlock()
+		if done {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(r.GetHistory("backlog", 10)) != 3 {
+		t.Errorf("all runs should be finished")
+	}
+}
+
+func TestRunner_StartObjectParams(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	conf := &TaskConfig{TaskID: "object", Command: "sleep 10"}
+	params := func(ids ...any) map[string]any {
+		return map[string]any{"TARGET": map[string]any{"ids": ids}, "N": int64(1)}
+	}
+	ent, err := r.Start(conf, params(1, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Start(conf, map[string]any{"TARGET": map[string]any{"ids": []any{1.0, 2.0}}, "N": 1.0}); err == nil {
+		t.Error("same params should be refused")
+	}
+	ent2, err := r.Start(conf, params(3))
+	if err != nil {
+		t.Fatalf("different params should be started: %v", err)
+	}
+	for _, e := range []*LogEntry{ent, ent2} {
+		r.Stop("object", e.RunID)
+		r.WaitRun(context.Background(), "object", e.RunID)
+	}
+}
+
+func TestRunner_When(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	conf := func() *TaskConfig {
+		return &TaskConfig{TaskID: "when", AllowParallel: true, Steps: []*TaskConfig{
+			{Name: "a", Command: "echo N=3 >> $GOTASK_OUTPUT"},
+			{Name: "deploy", Command: "true", Depends: []string{"a"}, Variables: map[string]any{"ENV": "staging"}, When: `ENV == "prod" && N == "3"`},
+		}}
+	}
+	tests := []struct {
+		params map[string]any
+		status string
+	}{
+		{map[string]any{"ENV": "prod"}, "success"},
+		{nil, "skipped"},
+	}
+	for _, tt := range tests {
+		ent, _ := r.RunAndWait(context.Background(), conf(), tt.params)
+		if s := ent.Task.Steps[1]; s.Status != tt.status {
+			t.Errorf("%v: %s %s", tt.params, s.Status, s.Message)
+		}
+	}
+}
+
+func TestRunner_Recover(t *testing.T) {
+	tasksDir, logDir := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(tasksDir, "recover.yaml"), []byte(`
+onInterrupted: resume
+steps:
+  - name: a
+    command: "false"
+  - name: b
+    command: "true"
+    depends: [a]
+`), 0644)
+	os.MkdirAll(filepath.Join(logDir, "recover"), 0755)
+	save := func(ent *LogEntry) {
+		b, _ := json.Marshal(ent)
+		os.WriteFile(filepath.Join(logDir, "recover", fmt.Sprintf("%d.run.json", ent.RunID)), b, 0644)
+	}
+	// the server stopped while b was running.
+	save(&LogEntry{TaskID: "recover", RunID: 1, Task: &TaskState{Status: "running", Steps: []*TaskState{
+		{Name: "a", Status: "success"},
+		{Name: "b", Status: "running", Depends: []string{"a"}},
+	}}})
+	// finished but the server stopped before the run was logged.
+	save(&LogEntry{TaskID: "recover", RunID: 2, Task: &TaskState{Status: "success", Steps: []*TaskState{
+		{Name: "a", Status: "success"},
+		{Name: "b", Status: "success", Depends: []string{"a"}},
+	}}})
+
+	r := NewRunner(&RunnerConfig{LogDir: logDir})
+	if err := r.Recover(NewManager(&ManagerConfig{TasksDir: tasksDir})); err != nil {
+		t.Fatal(err)
+	}
+	r.Shutdown(context.Background()) // waits for the resumed run
+	if files, _ := filepath.Glob(filepath.Join(logDir, "recover", "*.run.json")); len(files) != 0 {
+		t.Errorf("should be removed: %v", files)
+	}
+
+	status := map[int64]string{}
+	var resumed *LogEntry
+	for _, ent := range r.GetHistory("recover", 10) {
+		status[ent.RunID] = ent.Task.Status
+		if ent.RunID != 1 && ent.RunID != 2 {
+			resumed = ent
+		}
+	}
+	if status[1] != "interrupted" || status[2] != "success" {
+		t.Errorf("unexpected history: %v", status)
+	}
+	ent := r.GetRun("recover", 1)
+	if ent.Task.Steps[1].Status != "interrupted" || ent.Task.Message != "server stopped while running" {
+		t.Errorf("b should be interrupted: %s %q", ent.Task.Steps[1].Status, ent.Task.Message)
+	}
+	// resumed with the succeeded step reused. (a fails if it is run again)
+	if resumed == nil || resumed.Task.Steps[0].ReusedFrom != 1 || resumed.Task.Steps[1].Status != "success" {
+		t.Errorf("should be resumed: %+v", resumed)
+	}
+}
+
+func TestRunner_Timeout(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+	start := time.Now()
+	ent, _ := r.RunAndWait(context.Background(), &TaskConfig{TaskID: "timeout", Command: "sleep 10", Timeout: 100 * time.Millisecond}, nil)
+	if ent.Task.Status != "timeout" || time.Since(start) > 5*time.Second {
+		t.Errorf("should be timed out: %s %v", ent.Task.Status, time.Since(start))
+	}
+
+	// the timeout is applied to each attempt.
+	ent, _ = r.RunAndWait(context.Background(), &TaskConfig{TaskID: "timeout", Command: "sleep 10", Timeout: 100 * time.Millisecond,
+		Retry: &RetryConfig{MaxAttempts: 2}}, nil)
+	if ent.Task.Status != "timeout" || len(ent.Task.Attempts) != 2 || ent.Task.Attempts[0].Status != "timeout" {
+		t.Errorf("should be retried after the timeout: %s %d", ent.Task.Status, len(ent.Task.Attempts))
+	}
+
+	// the timeout of the DAG stops the retries.
+	start = time.Now()
+	ent, _ = r.RunAndWait(context.Background(), &TaskConfig{TaskID: "timeout", Timeout: 300 * time.Millisecond, Steps: []*TaskConfig{
+		{Name: "a", Command: "sleep 10", Timeout: 100 * time.Millisecond, Retry: &RetryConfig{MaxAttempts: 100}},
+	}}, nil)
+	if ent.Task.Status != "timeout" || len(ent.Task.Steps[0].Attempts) >= 100 || time.Since(start) > 5*time.Second {
+		t.Errorf("should be timed out: %s %d %v", ent.Task.Status, len(ent.Task.Steps[0].Attempts), time.Since(start))
+	}
+}
+
+func TestRunner_NamedQueues(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir(), Queues: map[string]int{"heavy": 1}})
+	if _, err := r.Start(&TaskConfig{TaskID: "queue", Queue: "unknown", Command: "true"}, nil); err == nil {
+		t.Error("unknown queue should be rejected")
+	}
+	ent, err := r.Start(&TaskConfig{TaskID: "queue", Queue: "heavy", Command: "sleep 10"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitRunState(r, "queue", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Status == "running" })
+	stats := map[string]*QueueStats{}
+	for _, st := range r.Queues() {
+		stats[st.Name] = st
+	}
+	heavy, def := stats["heavy"], stats[DefaultQueue]
+	if heavy == nil || heavy.Parallel != 1 || heavy.Running != 1 || len(heavy.Entries) != 1 || !strings.HasPrefix(heavy.Entries[0], fmt.Sprintf("queue:%d:", ent.RunID)) {
+		t.Errorf("the run should be in the heavy queue: %+v", heavy)
+	}
+	if def == nil || def.Running != 0 {
+		t.Errorf("the default queue should be empty: %+v", def)
+	}
+	r.Stop("queue", ent.RunID)
+	r.WaitRun(context.Background(), "queue", ent.RunID)
+}
+
+func TestRunner_OverflowPolicy(t *testing.T) {
+	conf := func(command string) *TaskConfig {
+		return &TaskConfig{TaskID: "overflow", Command: command, AllowParallel: true}
+	}
+	// fill runs a command and queues another one in the queue of size 1.
+	fill := func(r *Runner, command string) {
+		ent, _ := r.Start(conf(command), nil)
+		waitRunState(r, "overflow", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Status == "running" })
+		r.Start(conf(command), nil)
+		for i := 0; i < 100 && !r.Queue(DefaultQueue).Full(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	newRunner := func(policy string, timeout time.Duration) *Runner {
+		return NewRunner(&RunnerConfig{LogDir: t.TempDir(), Parallel: 1, QueueSize: 1, OverflowPolicy: policy, OverflowTimeout: timeout})
+	}
+
+	r := newRunner(OverflowReject, 0)
+	fill(r, "sleep 10")
+	_, err := r.Start(conf("true"), nil)
+	if !errors.Is(err, ErrQueueFull) {
+		t.Errorf("should be rejected: %v", err)
+	}
+	w := httptest.NewRecorder()
+	writeStartResponse(w, httptest.NewRequest("POST", "/", nil), nil, err, 0)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("should be 429: %d", w.Code)
+	}
+	r.Shutdown(canceledContext())
+
+	r = newRunner(OverflowBlock, 0)
+	fill(r, "sleep 0.2")
+	ent, err := r.Start(conf("true"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ent, _ = r.WaitRun(context.Background(), "overflow", ent.RunID)
+	if ent.Task.Status != "success" {
+		t.Errorf("should wait for the queue: %s %s", ent.Task.Status, ent.Task.Message)
+	}
+	r.Shutdown(context.Background())
+
+	r = newRunner(OverflowBlock, 100*time.Millisecond)
+	fill(r, "sleep 10")
+	ent, _ = r.RunAndWait(context.Background(), conf("true"), nil)
+	if ent.Task.Status != "failed" || ent.Task.Message != "failed to enqueue" {
+		t.Errorf("should be failed after the timeout: %s %s", ent.Task.Status, ent.Task.Message)
+	}
+	r.Shutdown(canceledContext())
+
+	r = newRunner(OverflowSpill, 0)
+	fill(r, "sleep 0.2")
+	ent, err = r.Start(conf("true"), nil)
+	if err != nil || ent.Task.Status != "backlog" {
+		t.Fatalf("should be kept in the backlog: %v %v", err, ent)
+	}
+	var saved []*backlogEntry
+	b, _ := os.ReadFile(r.backlogPath())
+	if json.Unmarshal(b, &saved) != nil || len(saved) != 1 || saved[0].Log.RunID != ent.RunID {
+		t.Errorf("the backlog should be saved: %s", b)
+	}
+	ent, _ = r.WaitRun(context.Background(), "overflow", ent.RunID)
+	if ent.Task.Status != "success" {
+		t.Errorf("should be started from the backlog: %s", ent.Task.Status)
+	}
+	b, _ = os.ReadFile(r.backlogPath())
+	if json.Unmarshal(b, &saved) != nil || len(saved) != 0 {
+		t.Errorf("the backlog should be drained: %s", b)
+	}
+	r.Shutdown(context.Background())
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
+func TestRunner_Metrics(t *testing.T) {
+	r := NewRunner(&RunnerConfig{LogDir: t.TempDir(), Parallel: 1, QueueSize: 1, OverflowPolicy: OverflowBlock, OverflowTimeout: 100 * time.Millisecond})
+	metrics := func() string {
+		var b strings.Builder
+		r.Metrics().Write(&b)
+		writeQueueMetrics(&b, r.Queues())
+		return b.String()
+	}
+	r.RunAndWait(context.Background(), &TaskConfig{TaskID: "metrics", Command: "true"}, nil)
+	r.RunAndWait(context.Background(), &TaskConfig{TaskID: "metrics", Command: "exit 1"}, nil)
+	r.RunAndWait(context.Background(), &TaskConfig{TaskID: "metrics", Steps: []*TaskConfig{{Name: "a", Command: "true"}}}, nil)
+	m := metrics()
+	for _, line := range []string{
+		`gotask_runs_started_total{task_id="metrics"} 3`,
+		`gotask_runs_finished_total{task_id="metrics",status="success"} 2`,
+		`gotask_runs_finished_total{task_id="metrics",status="failed"} 1`,
+		`gotask_step_duration_seconds_count{task_id="metrics",step="a"} 1`,
+		`gotask_queue_rejected_total{queue="default"} 0`,
+	} {
+		if !strings.Contains(m, line+"\n") {
+			t.Errorf("%s is not found in:\n%s", line, m)
+		}
+	}
+
+	// the queue is filled by a running one and a pending one.
+	ent, _ := r.Start(&TaskConfig{TaskID: "metrics", Command: "sleep 10", AllowParallel: true}, nil)
+	waitRunState(r, "metrics", ent.RunID, func(ent *LogEntry) bool { return ent.Task.Status == "running" })
+	r.Start(&TaskConfig{TaskID: "metrics", Command: "sleep 10", AllowParallel: true}, nil)
+	for i := 0; i < 100 && !r.Queue(DefaultQueue).Full(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	m = metrics()
+	for _, line := range []string{
+		`gotask_queue_running{queue="default"} 1`,
+		`gotask_queue_pending{queue="default"} 1`,
+	} {
+		if !strings.Contains(m, line+"\n") {
+			t.Errorf("%s is not found in:\n%s", line, m)
+		}
+	}
+	r.RunAndWait(context.Background(), &TaskConfig{TaskID: "metrics", Command: "true", AllowParallel: true}, nil)
+	if m := metrics(); !strings.Contains(m, `gotask_queue_rejected_total{queue="default"} 1`+"\n") {
+		t.Errorf("the rejected entry should be counted:\n%s", m)
+	}
+	r.Shutdown(canceledContext())
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"sync"
+	"time"
 
 	"github.com/robfig/cron/v3"
 	"gopkg.in/yaml.v3"
@@ -33,6 +34,11 @@ func (s *Scheduler) Start() error {
 	return err
 }
 
+// Stop stops the scheduler and waits for the running jobs.
+func (s *Scheduler) Stop() {
+	<-s.c.Stop().Done()
+}
+
 func (s *Scheduler) Reload() error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -95,6 +101,19 @@ func (s *Scheduler) GetSchedule(taskId string) *SchedulerEntry {
 	return nil
 }
 
+// NextTimes returns the next fire time of the schedules.
+func (s *Scheduler) NextTimes() map[string]time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	next := map[string]time.Time{}
+	for _, ent := range s.schedules {
+		if t := s.c.Entry(ent.cronid).Next; ent.cronid != 0 && !t.IsZero() {
+			next[ent.TaskID] = t
+		}
+	}
+	return next
+}
+
 func (s *Scheduler) Set(taskID string, schedule string) error {
 	s.Remove(taskID)
 	s.mutex.Lock()
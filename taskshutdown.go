@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultShutdownTimeout is short enough to finish before `docker stop` kills the process (10s).
+const DefaultShutdownTimeout = 5 * time.Second
+
+func (r *Runner) ShuttingDown() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.shutdown
+}
+
+// Shutdown refuses new runs and waits for the running runs to finish.
+// The runs still running when ctx is done are interrupted and restarted by Recover after restart.
+func (r *Runner) Shutdown(ctx context.Context) {
+	r.mutex.Lock()
+	r.shutdown = true
+	r.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.mutex.RLock()
+		runnings := append([]*runState{}, r.runnings...)
+		r.mutex.RUnlock()
+		for _, state := range runnings {
+			state.stop(ErrShuttingDown) // sends SIGTERM to the commands
+		}
+		r.stopNotify() // the notifications in progress are not waited for
+		<-done
+	}
+	r.stopQueues()
+	for _, q := range r.queues {
+		q.Wait()
+	}
+}
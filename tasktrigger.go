@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Trigger rules of the steps.
+const (
+	TriggerAllSuccess = "all_success" // default
+	TriggerAllDone    = "all_done"
+	TriggerOneFailed  = "one_failed"
+	TriggerAlways     = "always" // run even if the task is canceled
+)
+
+func (ts *TaskState) finished() bool {
+	switch ts.Status {
+	case "success", "failed", "canceled", "timeout", "interrupted", "skipped", "upstream_failed", "rejected":
+		return true
+	}
+	return false
+}
+
+func (ts *TaskState) succeeded() bool {
+	return ts.Status == "success" || ts.Status == "skipped"
+}
+
+// triggered returns whether the step should be started, or the status for the step not to be started.
+func triggered(trigger string, deps []*TaskState) (bool, string) {
+	failed := false
+	for _, d := range deps {
+		if !d.finished() {
+			return false, ""
+		}
+		failed = failed || !d.succeeded()
+	}
+	switch trigger {
+	case TriggerAllDone, TriggerAlways:
+		return true, ""
+	case TriggerOneFailed:
+		if failed {
+			return true, ""
+		}
+		return false, "skipped"
+	default:
+		if failed {
+			return false, "upstream_failed"
+		}
+		return true, ""
+	}
+}
+
+// conditionTimeout limits the evaluation of the condition not to block the run. e.g. `while(true){}`
+const conditionTimeout = time.Second
+
+// EvalCondition evaluates the JavaScript expression with the params as global variables.
+func EvalCondition(expr string, params map[string]any) (bool, error) {
+	vm := goja.New()
+	for k, v := range params {
+		if err := vm.Set(k, v); err != nil {
+			return false, err
+		}
+	}
+	timer := time.AfterFunc(conditionTimeout, func() { vm.Interrupt("timeout") })
+	defer timer.Stop()
+	v, err := vm.RunString(expr)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %w", expr, err)
+	}
+	return v.ToBoolean(), nil
+}
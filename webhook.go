@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxWebhookBody = 1 << 20
+
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// default signature headers. X-Hub-Signature-256 has "sha256=" prefix.
+var signatureHeaders = []string{"X-Hub-Signature-256", "X-Gitea-Signature", "X-Gogs-Signature"}
+
+type WebhookConfig struct {
+	Secret          string            `json:"-"`
+	SignatureHeader string            `json:"signatureHeader,omitempty" yaml:"signatureHeader"`
+	Params          map[string]string `json:"params,omitempty"` // param name -> JSON field path (e.g. repository.full_name)
+}
+
+// Verify checks the HMAC-SHA256 signature of the body.
+func (conf *WebhookConfig) Verify(r *http.Request, body []byte) error {
+	if conf.Secret == "" {
+		return ErrInvalidSignature
+	}
+	headers := signatureHeaders
+	if conf.SignatureHeader != "" {
+		headers = []string{conf.SignatureHeader}
+	}
+	var sig string
+	for _, h := range headers {
+		if sig = r.Header.Get(h); sig != "" {
+			break
+		}
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(sig, "sha256="))
+	if err != nil || len(expected) == 0 {
+		return ErrInvalidSignature
+	}
+	mac := hmac.New(sha256.New, []byte(conf.Secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func lookupField(v any, path string) (any, bool) {
+	for _, key := range strings.Split(path, ".") {
+		switch o := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = o[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(o) {
+				return nil, false
+			}
+			v = o[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// MapParams extracts the params from the JSON payload. Missing fields are ignored.
+func (conf *WebhookConfig) MapParams(payload any) map[string]any {
+	params := map[string]any{}
+	for name, path := range conf.Params {
+		v, ok := lookupField(payload, path)
+		if !ok || v == nil {
+			continue
+		}
+		switch v.(type) {
+		case map[string]any, []any:
+			b, _ := json.Marshal(v)
+			v = string(b)
+		}
+		params[name] = normalizeNumbers(v)
+	}
+	return params
+}
+
+// webhookHandler starts the task by POST /hooks/{taskId}. The requests are authenticated by the signature.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	taskID := strings.SplitN(r.URL.Path, "/", 2)[0]
+	task, err := manager.Load(taskID)
+	if err != nil || task.Webhook == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if err := task.Webhook.Verify(r, body); err != nil {
+		log.Println("webhook:", taskID, err)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var payload any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // ids in the payloads may exceed 2^53
+	if err := dec.Decode(&payload); err != nil {
+		http.Error(w, "invalid json", http.StatusBadRequest)
+		return
+	}
+
+	params := map[string]any{}
+	for k, v := range task.Variables {
+		params[k] = v
+	}
+	for k, v := range task.Webhook.MapParams(payload) {
+		params[k] = v
+	}
+	res := struct {
+		TaskID  string `json:"taskId"`
+		RunID   int64  `json:"runId"`
+		Ok      bool   `json:"ok"`
+		Message string `json:"message,omitempty"`
+	}{TaskID: taskID}
+	ent, err := runner.Start(task, params)
+	if err == nil {
+		res.RunID = ent.RunID
+		res.Ok = true
+	} else {
+		res.Message = err.Error()
+		writeStartError(w, err)
+	}
+	responseJson(w, &res)
+}
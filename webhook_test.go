@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWebhook_Verify(t *testing.T) {
+	conf := &WebhookConfig{Secret: "secret"}
+	body := []byte(`{"ref":"refs/heads/main"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		header string
+		value  string
+		ok     bool
+	}{
+		{"X-Hub-Signature-256", "sha256=" + sig, true},
+		{"X-Gitea-Signature", sig, true},
+		{"X-Hub-Signature-256", "sha256=00" + sig[2:], false},
+		{"X-Other", sig, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/hooks/test", nil)
+		r.Header.Set(tt.header, tt.value)
+		if err := conf.Verify(r, body); (err == nil) != tt.ok {
+			t.Errorf("Verify(%s: %s) = %v", tt.header, tt.value, err)
+		}
+	}
+}
+
+func TestWebhook_MapParams(t *testing.T) {
+	conf := &WebhookConfig{Params: map[string]string{
+		"REF":    "ref",
+		"REPO":   "repository.full_name",
+		"COMMIT": "commits.0.id",
+		"FORCED": "forced",
+		"NONE":   "repository.missing",
+		"ID":     "repository.id",
+	}}
+	var payload any
+	dec := json.NewDecoder(strings.NewReader(`{"ref":"refs/heads/main","forced":true,"repository":{"full_name":"a/b","id":1234567890123456789},"commits":[{"id":"abc"}]}`))
+	dec.UseNumber()
+	dec.Decode(&payload)
+	params := conf.MapParams(payload)
+	expected := map[string]any{"REF": "refs/heads/main", "REPO": "a/b", "COMMIT": "abc", "FORCED": true, "ID": int64(1234567890123456789)}
+	if len(params) != len(expected) {
+		t.Errorf("unexpected params: %v", params)
+	}
+	for k, v := range expected {
+		if params[k] != v {
+			t.Errorf("%s: %v != %v", k, params[k], v)
+		}
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "hook.yaml"), []byte(`
+variables:
+  REF:
+command: echo "REF=$REF"
+webhook:
+  secret: secret
+  params:
+    REF: ref
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "undeclared.yaml"), []byte(`
+command: echo "REF=$REF"
+webhook:
+  secret: secret
+  params:
+    REF: ref
+`), 0644)
+	oldManager, oldRunner := manager, runner
+	defer func() { manager, runner = oldManager, oldRunner }()
+	manager = NewManager(&ManagerConfig{TasksDir: dir})
+	runner = NewRunner(&RunnerConfig{LogDir: t.TempDir()})
+
+	post := func(taskID string) *httptest.ResponseRecorder {
+		body := `{"ref":"refs/heads/main"}`
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(body))
+		r := httptest.NewRequest("POST", "/hooks/"+taskID, strings.NewReader(body))
+		r.URL.Path = taskID // stripped by the mux
+		r.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		w := httptest.NewRecorder()
+		webhookHandler(w, r)
+		return w
+	}
+
+	w := post("hook")
+	var res struct {
+		RunID int64 `json:"runId"`
+	}
+	if json.NewDecoder(w.Body).Decode(&res); res.RunID == 0 {
+		t.Fatalf("should be started: %d", w.Code)
+	}
+	ent, _ := runner.WaitRun(context.Background(), "hook", res.RunID)
+	if b, _ := os.ReadFile(filepath.Join(runner.LogDir(), ent.Task.LogFile)); string(b) != "REF=refs/heads/main\n" {
+		t.Errorf("param should be passed to the command: %q", b)
+	}
+
+	if w := post("undeclared"); w.Code != http.StatusBadRequest {
+		t.Errorf("undeclared param should be rejected: %d %s", w.Code, w.Body)
+	}
+}